@@ -0,0 +1,208 @@
+package kwiscale
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// secretConfigFields are Config fields that are never displayed by admin
+// routes.
+var secretConfigFields = map[string]bool{
+	"SessionSecret": true,
+	// may hold session engine passwords
+	"SessionEngineOptions": true,
+	"AdminToken":           true,
+	"OAuthProviders":       true,
+	"URLSigningKeys":       true,
+}
+
+// adminHandler serves debug routes (pprof, routes, config...) when
+// Config.AdminEnabled is true and debug mode is on. Requests must give
+// Config.AdminToken, loopback clients are accepted without token only if
+// Config.AdminAllowLoopback is set.
+type adminHandler struct{ RequestHandler }
+
+// Init refuses the request if debug mode is off or if client is not allowed.
+func (h *adminHandler) Init() (int, error) {
+	if !debug.Load() {
+		return http.StatusNotFound, ErrNotFound
+	}
+	if !h.allowed() {
+		return http.StatusForbidden, ErrForbidden
+	}
+	return -1, nil
+}
+
+// allowed checks admin token, or client address if loopback clients are
+// allowed. Behind a local reverse proxy, every client is a loopback client.
+func (h *adminHandler) allowed() bool {
+	if token := h.app.Config.AdminToken; token != "" {
+		given := h.request.Header.Get("X-Admin-Token")
+		if auth := h.request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+	if !h.app.Config.AdminAllowLoopback {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(h.request.RemoteAddr)
+	if err != nil {
+		host = h.request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Get dispatches admin routes.
+func (h *adminHandler) Get() {
+	path := strings.Trim(h.Vars["path"], "/")
+	switch {
+	case path == "":
+		h.WriteJSON([]string{"routes", "config", "handlers", "rooms", "runtime", "pprof/"})
+	case path == "routes":
+		h.WriteJSON(h.routes())
+	case path == "config":
+		h.WriteJSON(redactedConfig(h.app.Config))
+	case path == "handlers":
+		h.WriteJSON(h.handlers())
+	case path == "rooms":
+		h.WriteJSON(roomStats())
+	case path == "runtime":
+		h.WriteJSON(runtimeStats(h.app))
+	case path == "pprof":
+		pprof.Index(h.response, h.request)
+	case strings.HasPrefix(path, "pprof/"):
+		h.pprof(strings.TrimPrefix(path, "pprof/"))
+	default:
+		h.app.Error(http.StatusNotFound, h.response, ErrNotFound, h.request.URL)
+	}
+}
+
+// Post is needed by pprof "symbol" route.
+func (h *adminHandler) Post() {
+	h.Get()
+}
+
+// pprof calls the net/http/pprof handler for "name".
+func (h *adminHandler) pprof(name string) {
+	switch name {
+	case "":
+		pprof.Index(h.response, h.request)
+	case "cmdline":
+		pprof.Cmdline(h.response, h.request)
+	case "profile":
+		pprof.Profile(h.response, h.request)
+	case "symbol":
+		pprof.Symbol(h.response, h.request)
+	case "trace":
+		pprof.Trace(h.response, h.request)
+	default:
+		pprof.Handler(name).ServeHTTP(h.response, h.request)
+	}
+}
+
+// adminRoute describes a registered route.
+type adminRoute struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Handler string `json:"handler"`
+}
+
+// routes returns the route table sorted by path.
+func (h *adminHandler) routes() []adminRoute {
+	routes := []adminRoute{}
+	for _, r := range h.app.handlers {
+		handler := ""
+		if m := handlerManagerFor(r.handlername); m != nil {
+			handler = m.handler
+		}
+		routes = append(routes, adminRoute{r.handlername, r.route, handler})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Path < routes[j].Path
+	})
+	return routes
+}
+
+// handlers returns registered handler types and the handler managers.
+func (h *adminHandler) handlers() map[string]interface{} {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	types := map[string]string{}
+	for name, t := range handlerRegistry {
+		types[name] = t.PkgPath() + "." + t.Name()
+	}
+	managers := map[string]interface{}{}
+	for name, m := range handlerManagerRegistry {
+		managers[name] = map[string]interface{}{
+			"handler": m.handler,
+			"cached":  len(m.producer),
+		}
+	}
+	return map[string]interface{}{
+		"registry": types,
+		"managers": managers,
+	}
+}
+
+// redactedConfig returns config as a map, secret values are hidden and
+// values that cannot be encoded in JSON are formatted.
+func redactedConfig(config *Config) map[string]interface{} {
+	res := map[string]interface{}{}
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case secretConfigFields[field.Name]:
+			if !v.Field(i).IsZero() {
+				value = "[redacted]"
+			}
+		default:
+			if _, err := json.Marshal(value); err != nil {
+				value = fmt.Sprintf("%v", value)
+			}
+		}
+		res[field.Name] = value
+	}
+	return res
+}
+
+// roomStats returns the number of connections for each websocket room.
+func roomStats() map[string]int {
+	return rooms.stats()
+}
+
+// runtimeStats returns some go runtime information and framework counters.
+func runtimeStats(app *App) map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return map[string]interface{}{
+		"version":    runtime.Version(),
+		"cpus":       runtime.NumCPU(),
+		"goroutines": runtime.NumGoroutine(),
+		"timeouts":   app.timeouts.Load(),
+		"memory": map[string]interface{}{
+			"alloc":       mem.Alloc,
+			"total_alloc": mem.TotalAlloc,
+			"sys":         mem.Sys,
+			"heap_inuse":  mem.HeapInuse,
+			"num_gc":      mem.NumGC,
+		},
+	}
+}
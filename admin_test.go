@@ -0,0 +1,90 @@
+package kwiscale
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Create an app with admin routes and debug mode.
+func initAdminApp(t *testing.T, token string) *App {
+	SetDebug(true)
+	app := NewApp(&Config{
+		AdminEnabled:  true,
+		AdminToken:    token,
+		SessionSecret: []byte("top secret"),
+	})
+	T[app] = t
+	return app
+}
+
+// Test that config is displayed without secrets, to loopback clients only
+// when they are allowed.
+func TestAdminConfig(t *testing.T) {
+	app := initAdminApp(t, "")
+	defer SetDebug(false)
+
+	r := httptest.NewRequest("GET", "http://example.com/debug/config", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("Admin should refuse non loopback client, got", w.Code)
+	}
+
+	r.RemoteAddr = "127.0.0.1:4242"
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("Admin should refuse loopback client by default, got", w.Code)
+	}
+
+	app.Config.AdminAllowLoopback = true
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("Admin should accept loopback client, got", w.Code)
+	}
+
+	conf := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &conf)
+	if conf["SessionSecret"] != "[redacted]" {
+		t.Fatal("Session secret is not redacted:", conf["SessionSecret"])
+	}
+}
+
+// Test token protection and route table.
+func TestAdminToken(t *testing.T) {
+	app := initAdminApp(t, "letmein")
+	defer SetDebug(false)
+
+	r := httptest.NewRequest("GET", "http://example.com/debug/routes", nil)
+	r.RemoteAddr = "127.0.0.1:4242"
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("Admin should refuse request without token, got", w.Code)
+	}
+
+	r.Header.Set("Authorization", "Bearer letmein")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	routes := []adminRoute{}
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil || len(routes) == 0 {
+		t.Fatal("Route table is not given:", w.Body.String(), err)
+	}
+}
+
+// Test that admin routes are hidden when debug mode is off.
+func TestAdminNoDebug(t *testing.T) {
+	app := initAdminApp(t, "")
+	SetDebug(false)
+
+	r := httptest.NewRequest("GET", "http://example.com/debug/config", nil)
+	r.RemoteAddr = "127.0.0.1:4242"
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatal("Admin should not respond without debug mode, got", w.Code)
+	}
+}
@@ -1,6 +1,7 @@
 package kwiscale
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 	"gopkg.in/yaml.v2"
@@ -23,6 +26,17 @@ var handlerManagerRegistry = make(map[string]*handlerManager)
 // handlerRegistry keep the entire handlers - map[name]type.
 var handlerRegistry = make(map[string]reflect.Type)
 
+// registryLock protects handlerRegistry and handlerManagerRegistry, routes
+// may be added while requests are served.
+var registryLock sync.RWMutex
+
+// handlerManagerFor returns the handler manager of name, or nil.
+func handlerManagerFor(name string) *handlerManager {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return handlerManagerRegistry[name]
+}
+
 // regexp to find url ordered params from gorilla form.
 var urlParamRegexp = regexp.MustCompile(`\{(.+?):`)
 
@@ -32,6 +46,8 @@ var urlParamRegexp = regexp.MustCompile(`\{(.+?):`)
 func Register(h WebHandler) {
 	elem := reflect.ValueOf(h).Elem().Type()
 	name := elem.String()
+	registryLock.Lock()
+	defer registryLock.Unlock()
 	if _, exists := handlerRegistry[name]; !exists {
 		handlerRegistry[name] = elem
 	}
@@ -65,6 +81,41 @@ type App struct {
 
 	// Handler name for error handler.
 	errorHandler string
+
+	// http server started by ListenAndServe
+	server     *http.Server
+	serverLock sync.Mutex
+
+	// registered health checks
+	healthChecks []healthCheck
+	healthLock   sync.RWMutex
+
+	// set to 1 when app is shutting down or handler production is stopped
+	shuttingDown int32
+	stopped      int32
+
+	// reporters that receive panics and server errors
+	reporters []ErrorReporter
+
+	// middlewares called before handlers
+	middlewares []Middleware
+
+	// authenticators that find the request user
+	authenticators []Authenticator
+
+	// OAuth providers by name
+	oauthProviders map[string]*OAuthProvider
+	oauthLock      sync.RWMutex
+
+	// store used by rate limits
+	rateLimitStore RateLimitStore
+
+	// number of handlers that timed out
+	timeouts atomic.Int64
+
+	// options set on routes, by route name
+	routeOptions     map[string]*RouteOptions
+	routeOptionsLock sync.RWMutex
 }
 
 // NewApp Create new *App - App constructor.
@@ -81,8 +132,18 @@ func NewApp(config *Config) *App {
 		router:   mux.NewRouter(),
 		handlers: make(map[*mux.Route]handlerRouteMap),
 		Context:  make(map[string]interface{}),
+
+		routeOptions: make(map[string]*RouteOptions),
 	}
 
+	// built-in middlewares
+	if store, ok := newRateLimitStore(config.RateLimitStore); ok {
+		a.rateLimitStore = store
+	} else {
+		panic("Rate limit store not found: " + config.RateLimitStore)
+	}
+	a.Use(a.secureHeaders, a.cors, a.rateLimit, a.signedURL, a.bodyLimit, a.authenticate, a.csrf, a.compress, a.timeout)
+
 	// set sessstion store
 	a.sessionstore = sessionEngine[config.SessionEngine]
 	a.sessionstore.Name(config.SessionName)
@@ -96,6 +157,23 @@ func NewApp(config *Config) *App {
 
 	a.router.StrictSlash(config.StrictSlash)
 
+	if !config.DisableHealth {
+		a.AddNamedRoute(config.HealthPath, &healthHandler{}, "healthz")
+		a.AddNamedRoute(config.ReadinessPath, &readinessHandler{}, "readyz")
+		a.RouteOptions("healthz").builtin = true
+		a.RouteOptions("readyz").builtin = true
+	}
+
+	if config.AdminEnabled {
+		prefix := strings.TrimRight(config.AdminPrefix, "/")
+		a.AddNamedRoute(prefix+"/{path:.*}", &adminHandler{}, "kwiscale-admin")
+		a.RouteOptions("kwiscale-admin").builtin = true
+	}
+
+	for name, p := range config.OAuthProviders {
+		a.AddOAuthProvider(name, p)
+	}
+
 	// keep config
 	a.Config = config
 
@@ -129,10 +207,18 @@ func NewAppFromConfigFile(filename ...string) *App {
 	app := NewApp(cfg.parse())
 
 	for route, v := range cfg.Routes {
-		if handler, ok := handlerRegistry[v.Handler]; ok {
+		registryLock.RLock()
+		handler, ok := handlerRegistry[v.Handler]
+		registryLock.RUnlock()
+		if ok {
 			h := reflect.New(handler).Interface().(WebHandler)
 			log.Println(route, h, v.Alias)
 			app.addRoute(route, h, v.Alias)
+			name := v.Alias
+			if name == "" {
+				name = handler.String()
+			}
+			v.apply(app.RouteOptions(name))
 		} else {
 			panic("Handler not found: " + v.Handler)
 		}
@@ -141,14 +227,38 @@ func NewAppFromConfigFile(filename ...string) *App {
 	return app
 }
 
-// ListenAndServe calls http.ListenAndServe method
+// ListenAndServe starts a http.Server on configured port. The method returns
+// when Shutdown() is called.
 func (app *App) ListenAndServe(port ...string) {
 	p := app.Config.Port
 	if len(port) > 0 {
 		p = port[0]
 	}
 	log.Println("Listening", p)
-	log.Fatal(http.ListenAndServe(p, app))
+	server := &http.Server{Addr: p, Handler: app}
+	app.serverLock.Lock()
+	if atomic.LoadInt32(&app.shuttingDown) == 1 {
+		app.serverLock.Unlock()
+		return
+	}
+	app.server = server
+	app.serverLock.Unlock()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown gracefully stops the server started by ListenAndServe. Readiness
+// route responds "not ready" as soon as this method is called.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.serverLock.Lock()
+	atomic.StoreInt32(&app.shuttingDown, 1)
+	server := app.server
+	app.serverLock.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
 
 // SetStatic set the route "prefix" to serve files configured in Config.StaticDir
@@ -162,29 +272,55 @@ func (app *App) SetStatic(prefix string) {
 // Implement http.Handler ServeHTTP method.
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	rw := newResponseWriter(w, r)
+	w = rw
+
 	// try to recover panic if possible, and display
 	// an Error page
 	defer func() {
 		if err := recover(); err != nil {
-			app.Error(http.StatusInternalServerError,
-				w,
-				errors.New("An unexpected error occured"),
-				err,
-			)
+			app.recoverError(rw, err)
 		}
 	}()
 
-	var handler WebHandler
 	handlerName, route, match := getBestRoute(app, r)
+	rw.route = handlerName
 
 	// if non match
-	if _, ok := handlerManagerRegistry[handlerName]; !ok {
+	if handlerManagerFor(handlerName) == nil {
 		app.Error(http.StatusNotFound, w, ErrNotFound, r.URL)
 		return
 	}
 
+	// keep route name and options in request context for middlewares
+	r = r.WithContext(context.WithValue(r.Context(), routeContextKey, &routeContext{
+		name:    handlerName,
+		options: app.getRouteOptions(handlerName),
+	}))
+
+	// one session is shared by middlewares and handler, it is saved before
+	// the response starts and when the request ends
+	session := app.newRequestSession(rw, r)
+	r = r.WithContext(context.WithValue(r.Context(), sessionContextKey, session))
+	rw.request = r
+	w = &sessionWriter{ResponseWriter: w, save: session.saveOrLog}
+	defer session.saveOrLog()
+
+	app.chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.serveHandler(w, r, handlerName, route, match)
+	})).ServeHTTP(w, r)
+}
+
+// serveHandler gets a handler from the registry and calls the method that
+// matches the request.
+func (app *App) serveHandler(w http.ResponseWriter, r *http.Request, handlerName string, route *mux.Route, match mux.RouteMatch) {
+	// check route roles and permissions before Init() side effects
+	if !app.authorizeRoute(w, r) {
+		return
+	}
+
 	// wait for a built handler from registry
-	handler = <-handlerManagerRegistry[handlerName].produce()
+	handler := <-handlerManagerFor(handlerName).produce()
 	Log("Handler found ", handler)
 	//assign some vars
 	handler.setRoute(route)
@@ -209,27 +345,23 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// prepare defered destroy
 	defer handler.Destroy()
 
+	// check Authorize() hook
+	if !app.authorize(handler, w, r) {
+		return
+	}
+
 	// Websocket case
 	if h, ok := handler.(WSHandler); ok {
+		if err := h.OnConnect(); err != nil {
+			app.Error(http.StatusForbidden, w, err)
+			return
+		}
 		if err := h.upgrade(); err != nil {
 			log.Println("Error upgrading Websocket protocol", err)
 			return
 		}
 
-		defer h.OnClose()
-		h.OnConnect()
-
-		switch h.(type) {
-		case WSServerHandler:
-			serveWS(h)
-		case WSJsonHandler:
-			serveJSON(h)
-		case WSStringHandler:
-			serveString(h)
-		default:
-			app.Error(http.StatusNotImplemented, w, ErrNotImplemented)
-		}
-
+		serveWebSocket(h)
 		return
 	}
 
@@ -273,7 +405,7 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// we should NEVER go to this, but in case of...
 	details := "" +
-		fmt.Sprintf("Registry: %+v\n", handlerManagerRegistry) +
+		fmt.Sprintf("Registry: %+v\n", handlerManagerFor(handlerName)) +
 		fmt.Sprintf("RequestWriter: %+v\n", w) +
 		fmt.Sprintf("Reponse: %+v", r) +
 		fmt.Sprintf("KwiscaleHandler: %+v\n", handler)
@@ -292,6 +424,8 @@ func (app *App) handle(h WebHandler, name string) string {
 	Log("Register ", name)
 
 	Register(h)
+	registryLock.Lock()
+	defer registryLock.Unlock()
 	if _, ok := handlerManagerRegistry[name]; ok {
 		// do not create registry manager if it exists
 		Log("Registry manager for", name, "already exists")
@@ -301,9 +435,10 @@ func (app *App) handle(h WebHandler, name string) string {
 	// Append a new handler manager in registry
 
 	hm := &handlerManager{
-		handler:  handlerName,
-		closer:   make(chan int, 0),
-		producer: make(chan WebHandler, app.Config.NbHandlerCache),
+		handler:     handlerName,
+		handlerType: handlerType,
+		closer:      make(chan int, 0),
+		producer:    make(chan WebHandler, app.Config.NbHandlerCache),
 	}
 	handlerManagerRegistry[name] = hm
 	// to be able to fetch handler by real name, only if alias is not given
@@ -312,7 +447,7 @@ func (app *App) handle(h WebHandler, name string) string {
 	}
 
 	// start to produce handlers
-	go handlerManagerRegistry[name].produceHandlers()
+	go hm.produceHandlers()
 
 	// return the handler name
 	return name
@@ -357,8 +492,11 @@ func (app *App) addRoute(route string, handler WebHandler, routename string) {
 
 // SoftStop stops each handler manager goroutine (useful for testing).
 func (app *App) SoftStop() chan int {
+	atomic.StoreInt32(&app.stopped, 1)
 	c := make(chan int, 0)
 	go func() {
+		registryLock.RLock()
+		defer registryLock.RUnlock()
 		for name, closer := range handlerManagerRegistry {
 			Log("Closing ", name)
 			closer.closer <- 1
@@ -418,14 +556,56 @@ func (app *App) SetErrorHandler(h WebHandler) {
 	app.errorHandler = app.handle(h, "")
 }
 
-// Error displays an error page with details if any.
+// Error displays an error page with details if any. Server errors (status >= 500)
+// are sent to registered ErrorReporter.
 func (app *App) Error(status int, w http.ResponseWriter, err error, details ...interface{}) {
 	Log(err, details)
+	if status >= http.StatusInternalServerError {
+		app.report(&ErrorReport{
+			Status:  status,
+			Error:   err,
+			Details: details,
+		}, w)
+	}
+	app.renderError(status, w, err, details...)
+}
+
+// recoverError reports the recovered panic "p" with stack trace and displays
+// an error page. The stack trace is displayed only in debug mode.
+func (app *App) recoverError(w *responseWriter, p interface{}) {
+	err := errors.New("An unexpected error occured")
+	trace := stack()
+	// panic raised in a handler goroutine (see App.timeout)
+	if hp, ok := p.(*handlerPanic); ok {
+		p, trace = hp.value, hp.stack
+	}
+	Error(err, p, "\n", string(trace))
+	app.report(&ErrorReport{
+		Status: http.StatusInternalServerError,
+		Error:  err,
+		Panic:  p,
+		Stack:  trace,
+	}, w)
+
+	// response is already sent, we cannot display error page
+	if w.started() {
+		return
+	}
+
+	details := []interface{}{p}
+	if debug.Load() {
+		details = append(details, "\n\n", string(trace))
+	}
+	app.renderError(http.StatusInternalServerError, w, err, details...)
+}
+
+// renderError calls the error handler.
+func (app *App) renderError(status int, w http.ResponseWriter, err error, details ...interface{}) {
 	var handler WebHandler
 	if app.errorHandler == "" {
 		handler = &ErrorHandler{}
 	} else {
-		handler = <-handlerManagerRegistry[app.errorHandler].produce()
+		handler = <-handlerManagerFor(app.errorHandler).produce()
 	}
 	handler.setApp(app)
 	handler.setVars(nil, w, nil)
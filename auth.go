@@ -0,0 +1,258 @@
+package kwiscale
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// userSessionKey is the session key that keeps the logged in user id.
+const userSessionKey = "_kwiscale_user"
+
+// ErrUnauthorized is sent when a route requires an authenticated user.
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// User is an authenticated user, returned by an Authenticator.
+type User struct {
+	// ID identifies the user
+	ID string
+	// Name to display
+	Name string
+	// Roles and Permissions of the user
+	Roles       []string
+	Permissions []string
+	// Claims are extra information given by the authenticator (eg. JWT claims)
+	Claims map[string]interface{}
+}
+
+// Authenticator finds the user of a request. Authenticators are added with
+// App.AddAuthenticator() and are called in order until one returns a user.
+// Authenticate should return nil and no error if the request has no
+// credentials for the authenticator, and an error if the credentials are
+// not valid.
+type Authenticator interface {
+	Authenticate(w http.ResponseWriter, r *http.Request) (*User, error)
+}
+
+// challenger is implemented by authenticators that set a WWW-Authenticate
+// header when authentication is required.
+type challenger interface {
+	challenge() string
+}
+
+// appSetter is implemented by authenticators that need the App.
+type appSetter interface {
+	setApp(*App)
+}
+
+// AddAuthenticator appends authenticators to use on every request.
+func (app *App) AddAuthenticator(auth ...Authenticator) {
+	for _, a := range auth {
+		if s, ok := a.(appSetter); ok {
+			s.setApp(app)
+		}
+	}
+	app.authenticators = append(app.authenticators, auth...)
+}
+
+// authenticate is the built-in middleware that puts the request user in
+// context. An authenticator that fails doesn't prevent next ones to be
+// tried. If the route has RouteOptions.RequireAuth and there is no user, an
+// error 401 is sent.
+func (app *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User
+		for _, a := range app.authenticators {
+			u, err := a.Authenticate(w, r)
+			if err != nil {
+				Log("Authentication failed", err)
+				continue
+			}
+			if u != nil {
+				user = u
+				break
+			}
+		}
+
+		if user == nil {
+			if currentRoute(r).options.RequireAuth {
+				app.unauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthorized sends an error 401 with authenticators challenges.
+func (app *App) unauthorized(w http.ResponseWriter) {
+	seen := map[string]bool{}
+	for _, a := range app.authenticators {
+		if c, ok := a.(challenger); ok && !seen[c.challenge()] {
+			seen[c.challenge()] = true
+			w.Header().Add("WWW-Authenticate", c.challenge())
+		}
+	}
+	app.Error(http.StatusUnauthorized, w, ErrUnauthorized)
+}
+
+// requestUser returns the user of the request, or nil.
+func requestUser(r *http.Request) *User {
+	if r == nil {
+		return nil
+	}
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// User returns the authenticated user, or nil if the request is anonymous.
+func (b *BaseHandler) User() *User {
+	return requestUser(b.request)
+}
+
+// Login records the user id in session, SessionAuthenticator will return
+// the user for next requests. The session id is regenerated.
+func (b *BaseHandler) Login(user *User) {
+	if err := b.RegenerateSession(); err != nil && err != ErrSessionInvalidation {
+		Error("Cannot regenerate session", err)
+	}
+	b.SetSession(userSessionKey, user.ID)
+	b.request = b.request.WithContext(context.WithValue(b.request.Context(), userContextKey, user))
+}
+
+// Logout removes the user id and OAuth token from session. The session id
+// is regenerated.
+func (b *BaseHandler) Logout() {
+	if err := b.RegenerateSession(); err != nil && err != ErrSessionInvalidation {
+		Error("Cannot regenerate session", err)
+	}
+	for _, key := range []string{userSessionKey, oauthTokenSessionKey} {
+		if err := b.Session().Delete(key); err != nil {
+			Error("Cannot delete session", key, err)
+		}
+	}
+	b.request = b.request.WithContext(context.WithValue(b.request.Context(), userContextKey, (*User)(nil)))
+}
+
+// SessionAuthenticator returns the user recorded in session with
+// BaseHandler.Login().
+type SessionAuthenticator struct {
+	// Lookup returns the user from the id given at login. If nil, a User
+	// with only ID is returned.
+	Lookup func(id string) (*User, error)
+
+	app *App
+}
+
+// NewSessionAuthenticator returns a SessionAuthenticator that uses lookup
+// to find users.
+func NewSessionAuthenticator(lookup func(id string) (*User, error)) *SessionAuthenticator {
+	return &SessionAuthenticator{Lookup: lookup}
+}
+
+func (s *SessionAuthenticator) setApp(app *App) {
+	s.app = app
+}
+
+// Authenticate implements Authenticator.
+func (s *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*User, error) {
+	if s.app == nil {
+		return nil, errors.New("session authenticator is not added to an App")
+	}
+	session := requestSession(r)
+	if session == nil {
+		session = s.app.newRequestSession(w, r)
+	}
+	id, _ := session.Get(userSessionKey).(string)
+	if id == "" {
+		return nil, nil
+	}
+	if s.Lookup == nil {
+		return &User{ID: id}, nil
+	}
+	return s.Lookup(id)
+}
+
+// BasicAuthenticator checks HTTP Basic credentials.
+type BasicAuthenticator struct {
+	// Realm sent in WWW-Authenticate header
+	Realm string
+	// Check returns the user if password is valid, or an error.
+	Check func(username, password string) (*User, error)
+}
+
+// NewBasicAuthenticator returns a BasicAuthenticator.
+func NewBasicAuthenticator(realm string, check func(username, password string) (*User, error)) *BasicAuthenticator {
+	return &BasicAuthenticator{Realm: realm, Check: check}
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*User, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return a.Check(username, password)
+}
+
+func (a *BasicAuthenticator) challenge() string {
+	realm := a.Realm
+	if realm == "" {
+		realm = "Restricted"
+	}
+	return `Basic realm="` + strings.ReplaceAll(realm, `"`, "") + `"`
+}
+
+// APIKeyAuthenticator checks API keys given in "Authorization: Bearer"
+// header, or in a custom header.
+type APIKeyAuthenticator struct {
+	// Header is the header that holds the key, default is Authorization
+	// with "Bearer" scheme
+	Header string
+	// Keys maps API keys to users
+	Keys map[string]*User
+}
+
+// NewAPIKeyAuthenticator returns an APIKeyAuthenticator with keys.
+func NewAPIKeyAuthenticator(keys map[string]*User) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{Keys: keys}
+}
+
+// Authenticate implements Authenticator. Unknown keys are ignored to let
+// other bearer authenticators (eg. JWT) check them.
+func (a *APIKeyAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*User, error) {
+	var given string
+	if a.Header != "" {
+		given = r.Header.Get(a.Header)
+	} else {
+		given = bearerToken(r)
+	}
+	if given == "" {
+		return nil, nil
+	}
+	for key, user := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *APIKeyAuthenticator) challenge() string {
+	return "Bearer"
+}
+
+// bearerToken returns the token of the "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
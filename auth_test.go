@@ -0,0 +1,239 @@
+package kwiscale
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A handler that writes the user id.
+type userHandler struct{ RequestHandler }
+
+func (h *userHandler) Get() {
+	if u := h.User(); u != nil {
+		h.WriteString(u.ID)
+		return
+	}
+	h.WriteString("anonymous")
+}
+
+// A handler that logs in the "login" variable.
+type loginHandler struct{ RequestHandler }
+
+func (h *loginHandler) Get() {
+	h.Login(&User{ID: h.Vars["login"]})
+	h.WriteString(h.User().ID)
+}
+
+// A handler that logs out.
+type logoutHandler struct{ RequestHandler }
+
+func (h *logoutHandler) Get() {
+	h.Logout()
+	h.WriteString("bye")
+}
+
+// signJWT creates a token for tests, key is a []byte or *rsa.PrivateKey.
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}, kid ...string) string {
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if len(kid) > 0 {
+		h["kid"] = kid[0]
+	}
+	header, _ := json.Marshal(h)
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authApp returns an app with a public and a private route.
+func authApp(t *testing.T, auth ...Authenticator) *App {
+	app := initApp(t)
+	app.AddNamedRoute("/public", &userHandler{}, "public")
+	app.AddNamedRoute("/private", &userHandler{}, "private")
+	app.RouteOptions("private").RequireAuth = true
+	app.AddAuthenticator(auth...)
+	return app
+}
+
+// serve sends a request to app and returns the recorder.
+func serve(app *App, path string, header http.Header) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+// Test that required authentication responds 401 with a challenge.
+func TestAuthRequired(t *testing.T) {
+	app := authApp(t, NewBasicAuthenticator("kwiscale", func(user, password string) (*User, error) {
+		if user == "bob" && password == "secret" {
+			return &User{ID: "bob"}, nil
+		}
+		return nil, errors.New("bad password")
+	}))
+
+	if w := serve(app, "/public", nil); w.Body.String() != "anonymous" {
+		t.Fatal("Public route should be anonymous, got", w.Code, w.Body.String())
+	}
+	w := serve(app, "/private", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("Private route should respond 401, got", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") != `Basic realm="kwiscale"` {
+		t.Fatal("Bad challenge", w.Header().Get("WWW-Authenticate"))
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "secret")
+	if w := serve(app, "/private", r.Header); w.Body.String() != "bob" {
+		t.Fatal("Basic user should be authenticated, got", w.Code, w.Body.String())
+	}
+	r.SetBasicAuth("bob", "bad")
+	if w := serve(app, "/private", r.Header); w.Code != http.StatusUnauthorized {
+		t.Fatal("Bad password should respond 401, got", w.Code)
+	}
+}
+
+// Test API keys and HS256 tokens on the same header.
+func TestAuthBearer(t *testing.T) {
+	secret := []byte("jwt secret")
+	jwt := NewJWTAuthenticator(secret)
+	jwt.Issuer = "kwiscale"
+	app := authApp(t, NewAPIKeyAuthenticator(map[string]*User{"key-1": {ID: "robot"}}), jwt)
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	if w := serve(app, "/private", bearer("key-1")); w.Body.String() != "robot" {
+		t.Fatal("API key should be accepted, got", w.Code, w.Body.String())
+	}
+	if w := serve(app, "/private", bearer("key-2")); w.Code != http.StatusUnauthorized {
+		t.Fatal("Unknown key should respond 401, got", w.Code)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	token := signJWT(t, "HS256", secret, map[string]interface{}{"sub": "alice", "iss": "kwiscale", "exp": exp})
+	if w := serve(app, "/private", bearer(token)); w.Body.String() != "alice" {
+		t.Fatal("JWT should be accepted, got", w.Code, w.Body.String())
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"expired": {"sub": "alice", "iss": "kwiscale", "exp": float64(time.Now().Add(-time.Hour).Unix())},
+		"issuer":  {"sub": "alice", "iss": "other", "exp": exp},
+	} {
+		token := signJWT(t, "HS256", secret, claims)
+		if w := serve(app, "/private", bearer(token)); w.Code != http.StatusUnauthorized {
+			t.Fatal(name, "token should respond 401, got", w.Code)
+		}
+	}
+	token = signJWT(t, "HS256", []byte("bad secret"), map[string]interface{}{"sub": "alice", "iss": "kwiscale"})
+	if w := serve(app, "/private", bearer(token)); w.Code != http.StatusUnauthorized {
+		t.Fatal("Bad signature should respond 401, got", w.Code)
+	}
+}
+
+// Test RS256 tokens and that the algorithm must match the key type.
+func TestAuthJWTRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt := NewJWTAuthenticator(&key.PublicKey)
+	claims := map[string]interface{}{"sub": "carol", "roles": []string{"admin"}}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, "RS256", key, claims))
+	user, err := jwt.Authenticate(nil, r)
+	if err != nil || user.ID != "carol" || len(user.Roles) != 1 || user.Roles[0] != "admin" {
+		t.Fatal("RS256 token should be accepted", user, err)
+	}
+
+	// HS256 signed with the public key must be refused
+	pub, _ := json.Marshal(key.PublicKey)
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, "HS256", pub, claims))
+	if _, err := jwt.Authenticate(nil, r); err != ErrInvalidToken {
+		t.Fatal("Algorithm confusion should be refused, got", err)
+	}
+}
+
+// Test session login.
+func TestAuthSession(t *testing.T) {
+	app := authApp(t, NewSessionAuthenticator(nil))
+	app.AddRoute("/login/{login}", &loginHandler{})
+
+	w := serve(app, "/login/dave", nil)
+	cookie := w.Header().Get("Set-Cookie")
+	if w.Body.String() != "dave" || cookie == "" {
+		t.Fatal("Login should set session", w.Body.String(), w.Header())
+	}
+	if w := serve(app, "/private", http.Header{"Cookie": {cookie}}); w.Body.String() != "dave" {
+		t.Fatal("Session user should be authenticated, got", w.Code, w.Body.String())
+	}
+}
+
+// Test that a failing authenticator lets next ones find the user.
+func TestAuthFallback(t *testing.T) {
+	basic := NewBasicAuthenticator("kwiscale", func(user, password string) (*User, error) {
+		return nil, errors.New("bad password")
+	})
+	app := authApp(t, basic, NewSessionAuthenticator(nil))
+	app.AddRoute("/login/{login}", &loginHandler{})
+
+	cookie := serve(app, "/login/dave", nil).Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "bad")
+	r.Header.Set("Cookie", cookie)
+	if w := serve(app, "/private", r.Header); w.Body.String() != "dave" {
+		t.Fatal("Session user should be authenticated after basic failure, got", w.Code, w.Body.String())
+	}
+}
+
+// Test that logout removes the user and gives a new session id.
+func TestAuthLogout(t *testing.T) {
+	app := NewApp(&Config{SessionEngine: "memory"})
+	T[app] = t
+	app.AddNamedRoute("/private", &userHandler{}, "private")
+	app.RouteOptions("private").RequireAuth = true
+	app.AddAuthenticator(NewSessionAuthenticator(nil))
+	app.AddRoute("/login/{login}", &loginHandler{})
+	app.AddRoute("/logout", &logoutHandler{})
+
+	login := sessionCookie(t, serve(app, "/login/dave", nil))
+	logout := sessionCookie(t, serve(app, "/logout", login))
+	if logout.Get("Cookie") == login.Get("Cookie") {
+		t.Fatal("Logout should regenerate the session id")
+	}
+	for _, cookie := range []http.Header{login, logout} {
+		if w := serve(app, "/private", cookie); w.Code != http.StatusUnauthorized {
+			t.Fatal("User should be logged out, got", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package kwiscale
+
+import "net/http"
+
+// Authorizer is an optional handler interface. Authorize is called after
+// Init() with the request user (nil for anonymous requests) and method,
+// before the verb method or the websocket upgrade. Route roles and
+// permissions are checked before Init(). Return ErrUnauthorized to
+// ask for authentication, any other error denies access with a 403 status.
+type Authorizer interface {
+	Authorize(user *User, method string) error
+}
+
+// HasRole returns true if the user has the role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can returns true if the user has the permission.
+func (u *User) Can(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUser returns an error if user doesn't match route roles and
+// permissions. User must have one of the roles and every permissions.
+func (o *RouteOptions) checkUser(user *User) error {
+	if len(o.Roles) == 0 && len(o.Permissions) == 0 {
+		return nil
+	}
+	if user == nil {
+		return ErrUnauthorized
+	}
+	if len(o.Roles) > 0 {
+		allowed := false
+		for _, role := range o.Roles {
+			if user.HasRole(role) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrForbidden
+		}
+	}
+	for _, p := range o.Permissions {
+		if !user.Can(p) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+// authorizeRoute checks route roles and permissions, it is called before
+// the handler Init(). It sends an error 401 or 403 and returns false if
+// access is denied.
+func (app *App) authorizeRoute(w http.ResponseWriter, r *http.Request) bool {
+	return app.allow(w, r, currentRoute(r).options.checkUser(requestUser(r)))
+}
+
+// authorize calls the Authorizer hook of handler. It sends an error 401 or
+// 403 and returns false if access is denied.
+func (app *App) authorize(handler WebHandler, w http.ResponseWriter, r *http.Request) bool {
+	a, ok := handler.(Authorizer)
+	if !ok {
+		return true
+	}
+	return app.allow(w, r, a.Authorize(requestUser(r), r.Method))
+}
+
+// allow returns true if err is nil, otherwise it sends an error 401 or 403.
+func (app *App) allow(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	Log("Access denied", currentRoute(r).name, err)
+	if err == ErrUnauthorized || requestUser(r) == nil {
+		app.unauthorized(w)
+	} else {
+		app.Error(http.StatusForbidden, w, ErrForbidden)
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package kwiscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// A handler that only lets its owner write.
+type ownedHandler struct{ RequestHandler }
+
+func (h *ownedHandler) Authorize(user *User, method string) error {
+	if method != "GET" && (user == nil || user.ID != "owner") {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (h *ownedHandler) Get() {
+	h.WriteString("read")
+}
+
+func (h *ownedHandler) Post() {
+	h.WriteString("written")
+}
+
+// A websocket handler reserved to admins.
+type adminWSHandler struct{ WebSocketHandler }
+
+func (h *adminWSHandler) Authorize(user *User, method string) error {
+	if user == nil || !user.HasRole("admin") {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (h *adminWSHandler) OnMessage(int, string, error) {}
+
+// A handler that counts Init() calls.
+type initCountHandler struct{ RequestHandler }
+
+var initCount int
+
+func (h *initCountHandler) Init() (int, error) {
+	initCount++
+	return -1, nil
+}
+
+func (h *initCountHandler) Get() {
+	h.WriteString("ok")
+}
+
+// Test route roles and permissions.
+func TestAuthorizeRoute(t *testing.T) {
+	app := authApp(t, NewAPIKeyAuthenticator(map[string]*User{
+		"admin":  {ID: "a", Roles: []string{"admin"}, Permissions: []string{"read", "write"}},
+		"reader": {ID: "r", Roles: []string{"user"}, Permissions: []string{"read"}},
+	}))
+	app.AddNamedRoute("/admin", &userHandler{}, "admin")
+	app.RouteOptions("admin").Roles = []string{"admin", "staff"}
+	app.AddNamedRoute("/write", &userHandler{}, "write")
+	app.RouteOptions("write").Permissions = []string{"read", "write"}
+
+	tests := []struct {
+		path, key string
+		code      int
+	}{
+		{"/admin", "", http.StatusUnauthorized},
+		{"/admin", "reader", http.StatusForbidden},
+		{"/admin", "admin", http.StatusOK},
+		{"/write", "reader", http.StatusForbidden},
+		{"/write", "admin", http.StatusOK},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.key != "" {
+			header.Set("Authorization", "Bearer "+test.key)
+		}
+		if w := serve(app, test.path, header); w.Code != test.code {
+			t.Errorf("%s with key %q: expected %d, got %d", test.path, test.key, test.code, w.Code)
+		}
+	}
+}
+
+// Test that Init() is not called when route roles deny access.
+func TestAuthorizeBeforeInit(t *testing.T) {
+	app := authApp(t, NewAPIKeyAuthenticator(map[string]*User{
+		"admin": {ID: "a", Roles: []string{"admin"}},
+	}))
+	app.AddNamedRoute("/init", &initCountHandler{}, "init")
+	app.RouteOptions("init").Roles = []string{"admin"}
+
+	initCount = 0
+	if w := serve(app, "/init", nil); w.Code != http.StatusUnauthorized || initCount != 0 {
+		t.Fatal("Init should not be called for denied requests, got", w.Code, initCount)
+	}
+	header := http.Header{"Authorization": {"Bearer admin"}}
+	if w := serve(app, "/init", header); w.Code != http.StatusOK || initCount != 1 {
+		t.Fatal("Init should be called for allowed requests, got", w.Code, initCount)
+	}
+}
+
+// Test the Authorize hook on request and websocket handlers.
+func TestAuthorizeHook(t *testing.T) {
+	app := authApp(t, NewAPIKeyAuthenticator(map[string]*User{
+		"owner": {ID: "owner"},
+		"admin": {ID: "a", Roles: []string{"admin"}},
+	}))
+	app.AddRoute("/doc", &ownedHandler{})
+	app.AddRoute("/ws-admin", &adminWSHandler{})
+
+	post := func(key string) int {
+		r, _ := http.NewRequest("POST", "http://example.com/doc", nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Code
+	}
+	if w := serve(app, "/doc", nil); w.Body.String() != "read" {
+		t.Fatal("Anonymous read should be allowed, got", w.Code)
+	}
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Fatal("Anonymous write should respond 401, got", code)
+	}
+	if code := post("admin"); code != http.StatusForbidden {
+		t.Fatal("Other user write should respond 403, got", code)
+	}
+	if code := post("owner"); code != http.StatusOK {
+		t.Fatal("Owner write should be allowed, got", code)
+	}
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws-admin"
+	_, resp, err := websocket.DefaultDialer.Dial(u, http.Header{"Authorization": {"Bearer owner"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Websocket should be refused before upgrade", err)
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u, http.Header{"Authorization": {"Bearer admin"}})
+	if err != nil {
+		t.Fatal("Admin should connect websocket", err)
+	}
+	c.Close()
+}
@@ -2,12 +2,14 @@ package kwiscale
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 )
@@ -24,12 +26,12 @@ const (
 	STRING
 )
 
-// Enable debug logs.
-var debug = false
+// Enable debug logs, handler producers read it concurrently.
+var debug atomic.Bool
 
 // SetDebug changes debug mode.
 func SetDebug(mode bool) {
-	debug = mode
+	debug.Store(mode)
 }
 
 // WebHandler is the main handler interface that every handler sould
@@ -50,6 +52,7 @@ type WebHandler interface {
 	SetSession(interface{}, interface{})
 
 	setSessionStore(SessionStore)
+	saveSession()
 	Init() (status int, message error)
 	Destroy()
 	URL(...string) (*url.URL, error)
@@ -66,6 +69,7 @@ type BaseHandler struct {
 	request      *http.Request
 	Vars         map[string]string
 	sessionStore SessionStore
+	session      *Session
 
 	route     *mux.Route
 	app       *App
@@ -86,6 +90,7 @@ func (b *BaseHandler) setVars(v map[string]string, w http.ResponseWriter, req *h
 	b.Vars = v
 	b.response = w
 	b.request = req
+	b.session = nil
 }
 
 // setApp assign App to the handler
@@ -123,25 +128,71 @@ func (b *BaseHandler) setSessionStore(store SessionStore) {
 	b.sessionStore = store
 }
 
+// Session returns the request session, it is loaded on first access and
+// saved before the response is written. Middlewares and the handler share
+// the same session.
+func (b *BaseHandler) Session() *Session {
+	if b.session == nil {
+		b.session = requestSession(b.request)
+	}
+	if b.session == nil {
+		b.session = newSession(b, b.sessionStore)
+	}
+	return b.session
+}
+
+// saveSession records session changes.
+func (b *BaseHandler) saveSession() {
+	b.Session().saveOrLog()
+}
+
 // GetSession return the session value of "key".
 func (b *BaseHandler) GetSession(key interface{}) (interface{}, error) {
-	return b.sessionStore.Get(b, key)
+	v := b.Session().Get(key)
+	if v == nil {
+		return nil, ErrEmptySession
+	}
+	return v, nil
 }
 
-// SetSession set the "key" session to "value".
+// SetSession set the "key" session to "value". The error is logged after
+// a websocket upgrade, use Session().Set() to get it.
 func (b *BaseHandler) SetSession(key interface{}, value interface{}) {
-	b.sessionStore.Set(b, key, value)
+	if err := b.Session().Set(key, value); err != nil {
+		Error("Cannot set session", key, err)
+	}
 }
 
-// CleanSession remove every key/value of the current session.
+// CleanSession removes the current session, values are lost and the
+// client gets a new session on next write.
 func (b *BaseHandler) CleanSession() {
-	b.sessionStore.Clean(b)
+	if err := b.Session().clean(); err != nil {
+		Error("Cannot clean session", err)
+	}
 }
 
-// Payload returns the Body content.
+// RegenerateSession gives a new session id to the client, values are kept.
+// Call it when privileges change (Login() does it) to prevent session
+// fixation.
+func (b *BaseHandler) RegenerateSession() error {
+	return b.Session().regenerate()
+}
+
+// InvalidateAllSessions removes every sessions of a user, eg. after a
+// password change. See App.InvalidateAllSessions().
+func (b *BaseHandler) InvalidateAllSessions(userID string) error {
+	return b.app.InvalidateAllSessions(userID)
+}
+
+// Payload returns the Body content. If body exceeds BodyLimits.MaxBodySize,
+// an error 413 is sent and nil is returned.
 func (b *BaseHandler) Payload() []byte {
 	content, err := ioutil.ReadAll(b.request.Body)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			b.app.Error(http.StatusRequestEntityTooLarge, b.response, ErrRequestTooLarge)
+		}
 		return nil
 	}
 	return content
@@ -171,14 +222,20 @@ func (b *BaseHandler) PostValues() url.Values {
 }
 
 // GetPostFile returns the "name" file pointer and information from the post data.
+// Multipart form memory is limited by BodyLimits.MaxMultipartMemory.
 func (b *BaseHandler) GetPostFile(name string) (multipart.File, *multipart.FileHeader, error) {
-	b.request.ParseForm()
+	if b.request.MultipartForm == nil {
+		b.request.ParseMultipartForm(b.app.bodyLimits(b.request).maxMemory())
+	}
 	return b.request.FormFile(name)
 }
 
-// SavePostFile save the given "name" file to the "to" path.
+// SavePostFile save the given "name" file to the "to" path. The path is
+// refused if it contains ".." elements.
 func (b *BaseHandler) SavePostFile(name, to string) error {
-	b.request.ParseForm()
+	if err := checkPath(to); err != nil {
+		return err
+	}
 	file, _, err := b.GetPostFile(name)
 	if err != nil {
 		return err
@@ -0,0 +1,287 @@
+package kwiscale
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// default content types to compress.
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// supported encodings, by preference order.
+var defaultEncodings = []string{"br", "gzip", "deflate"}
+
+// CompressionConfig enables response compression, set it with
+// Config.Compression. Encoding is negotiated with the Accept-Encoding
+// header. Responses that already have a Content-Encoding (eg. precompressed
+// static files) are not compressed again.
+type CompressionConfig struct {
+	// MinSize is the minimum response size to compress, default is 1024 bytes
+	MinSize int `yaml:"minsize,omitempty"`
+	// Types are the content types to compress, "text/*" is allowed
+	Types []string `yaml:"types,omitempty"`
+	// Encodings are the allowed encodings by preference, default is br, gzip, deflate
+	Encodings []string `yaml:"encodings,omitempty"`
+	// Level is the compression level (from 1 to 9), default is 5
+	Level int `yaml:"level,omitempty"`
+}
+
+// minSize returns the minimum size to compress.
+func (c *CompressionConfig) minSize() int {
+	if c.MinSize <= 0 {
+		return 1024
+	}
+	return c.MinSize
+}
+
+// level returns the compression level.
+func (c *CompressionConfig) level() int {
+	if c.Level <= 0 || c.Level > 9 {
+		return 5
+	}
+	return c.Level
+}
+
+// allowType returns true if the content type should be compressed.
+func (c *CompressionConfig) allowType(contentType string) bool {
+	types := c.Types
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	for _, t := range types {
+		if t == contentType ||
+			strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate returns the best encoding accepted by client, or an empty string.
+func (c *CompressionConfig) negotiate(accept string) string {
+	encodings := c.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultEncodings
+	}
+	return negotiateEncoding(accept, encodings)
+}
+
+// negotiateEncoding returns the encoding with the best quality in accepted
+// header. Ties are resolved with "supported" order.
+func negotiateEncoding(accept string, supported []string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name != "" {
+			qualities[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range supported {
+		q, ok := qualities[enc]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the response until MinSize is reached, then
+// decides to compress or not.
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressionConfig
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	encoder  io.WriteCloser
+}
+
+// WriteHeader delays status until compression is decided.
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// responses without body
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent {
+		cw.decide(false)
+	}
+}
+
+// Write buffers or compresses data.
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.config.minSize() {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends headers and creates the encoder if compress is true and
+// if the response can be compressed.
+func (cw *compressWriter) decide(compress bool) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.config.allowType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// compressed body is another representation, it cannot share a
+		// strong validator or byte ranges with the identity body
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.encoder = newEncoder(cw.encoding, cw.ResponseWriter, cw.config.level())
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// start decides and writes the buffered data.
+func (cw *compressWriter) start(compress bool) error {
+	cw.decide(compress)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends buffered data (compressed if MinSize is reached).
+func (cw *compressWriter) Flush() {
+	cw.start(len(cw.buf) >= cw.config.minSize())
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response writer cannot be hijacked")
+}
+
+// Unwrap returns the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends remaining data without compression if it is too small, and
+// closes the encoder.
+func (cw *compressWriter) close() {
+	if cw.status == 0 && len(cw.buf) == 0 {
+		// nothing was written
+		return
+	}
+	cw.start(false)
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+}
+
+// newEncoder returns a compressor for the given encoding.
+func newEncoder(encoding string, w io.Writer, level int) io.WriteCloser {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, level)
+	case "deflate":
+		fw, _ := flate.NewWriter(w, level)
+		return fw
+	default:
+		gw, _ := gzip.NewWriterLevel(w, level)
+		return gw
+	}
+}
+
+// compress is the built-in middleware that compresses responses. It is
+// disabled for websocket upgrades and for routes where
+// RouteOptions.DisableCompression is set.
+func (app *App) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := app.Config.Compression
+		if c == nil || currentRoute(r).options.DisableCompression ||
+			r.Method == "HEAD" || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// not deferred, a panic should let the error page be written
+		cw := &compressWriter{ResponseWriter: w, config: c, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
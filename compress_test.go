@@ -0,0 +1,91 @@
+package kwiscale
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A handler that writes a large text response.
+type largeHandler struct{ RequestHandler }
+
+func (h *largeHandler) Get() {
+	h.response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	h.response.Header().Set("ETag", `"v1"`)
+	h.response.Header().Set("Accept-Ranges", "bytes")
+	h.WriteString(strings.Repeat("kwiscale ", 500))
+}
+
+// Test that large responses are compressed and small ones are not.
+func TestCompression(t *testing.T) {
+	app := initApp(t)
+	app.Config.Compression = &CompressionConfig{}
+	app.AddRoute("/large", &largeHandler{})
+	app.AddRoute("/foo", &TestHandler{})
+
+	r, _ := http.NewRequest("GET", "http://example.com/large", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("Response should be gzipped, got", w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal("Vary header is not set")
+	}
+	if w.Header().Get("ETag") != `W/"v1"` || w.Header().Get("Accept-Ranges") != "" {
+		t.Fatal("Compressed response should have a weak ETag and no ranges:", w.Header())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gr)
+	if string(body) != strings.Repeat("kwiscale ", 500) {
+		t.Fatal("Uncompressed body is not the response")
+	}
+
+	// too small
+	r, _ = http.NewRequest("GET", "http://example.com/foo", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "Hello" {
+		t.Fatal("Small response should not be compressed")
+	}
+
+	// not accepted by client
+	r, _ = http.NewRequest("GET", "http://example.com/large", nil)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("Response should not be compressed without Accept-Encoding")
+	}
+	if w.Header().Get("ETag") != `"v1"` || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatal("Identity response should keep its validators:", w.Header())
+	}
+}
+
+// Test encoding negotiation with quality values.
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"br", "gzip", "deflate"}
+	tests := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"gzip, br":                "br",
+		"br;q=0.5, gzip":          "gzip",
+		"br;q=0, deflate":         "deflate",
+		"*":                       "br",
+		"identity":                "",
+		"gzip;q=0.8, deflate;q=1": "deflate",
+	}
+	for accept, expected := range tests {
+		if enc := negotiateEncoding(accept, supported); enc != expected {
+			t.Errorf("%q: expected %q, got %q", accept, expected, enc)
+		}
+	}
+}
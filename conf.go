@@ -1,5 +1,7 @@
 package kwiscale
 
+import "time"
+
 // Config structure that holds configuration
 type Config struct {
 	// Root directory where TemplateEngine will get files
@@ -13,7 +15,8 @@ type Config struct {
 	// Template engine options (some addons need options)
 	TemplateEngineOptions TplOptions
 
-	// SessionEngine (default is a file storage)
+	// SessionEngine is the registered session engine name: "default" (cookie
+	// storage), "memory" or "file"
 	SessionEngine string
 	// SessionName is the name of session, eg. Cookie name, default is "kwiscale-session"
 	SessionName string
@@ -30,11 +33,65 @@ type Config struct {
 	// StrictSlash allows to match route that have trailing slashes
 	StrictSlash bool
 
+	// DisableHealth prevents health and readiness routes to be mounted
+	DisableHealth bool
+	// HealthPath is the health (liveness) route, default is "/healthz"
+	HealthPath string
+	// ReadinessPath is the readiness route, default is "/readyz"
+	ReadinessPath string
+
+	// AdminEnabled mounts debug/admin routes, they respond only in debug mode
+	AdminEnabled bool
+	// AdminPrefix is the admin routes prefix, default is "/debug"
+	AdminPrefix string
+	// AdminToken protects admin routes, requests must give it as "Bearer" authorization
+	AdminToken string
+	// AdminAllowLoopback accepts loopback clients without token, don't set it
+	// behind a local reverse proxy
+	AdminAllowLoopback bool
+
+	// CORS configuration for every routes (see RouteOptions to override it)
+	CORS *CORSConfig
+	// CSRF protection, disabled if nil (see RouteOptions to exempt routes)
+	CSRF *CSRFConfig
+	// Security headers and Content-Security-Policy, see NewSecurityConfig()
+	Security *SecurityConfig
+
+	// RateLimit applies to every routes (routes may have their own limit)
+	RateLimit *RateLimit
+	// WSRateLimit limits websocket messages per connection
+	WSRateLimit *RateLimit
+	// RateLimitStore is the registered store name, default is "memory"
+	RateLimitStore string
+
+	// BodyLimits constrains request body and uploaded files
+	BodyLimits *BodyLimits
+
+	// Timeout cancels handlers that take longer, 0 for no timeout
+	Timeout time.Duration
+
+	// Compression enables response compression, nil to disable
+	Compression *CompressionConfig
+
+	// OAuthPrefix is the OAuth login routes prefix, default is "/auth"
+	OAuthPrefix string
+	// OAuthProviders are registered with App.AddOAuthProvider()
+	OAuthProviders map[string]*OAuthProvider
+
+	// URLSigningKeys sign URLs given by App.SignedURL(), the first key signs
+	// and the others are accepted (to rotate keys). Default key is derived
+	// from SessionSecret, URLs are not signed if it is not set.
+	URLSigningKeys []string
+
 	// Datastrore
 	//DB        string
 	//DBOptions DBOptions
 }
 
+// defaultSessionSecret is used when Config.SessionSecret is not set, it is
+// public so it must not sign anything but sessions of development apps.
+const defaultSessionSecret = "A very long secret string you should change"
+
 // Initialize config default values if some are not defined
 func initConfig(config *Config) *Config {
 	if config == nil {
@@ -64,12 +121,31 @@ func initConfig(config *Config) *Config {
 		config.SessionName = "kwiscale-session"
 	}
 	if config.SessionSecret == nil {
-		config.SessionSecret = []byte("A very long secret string you should change")
+		config.SessionSecret = []byte(defaultSessionSecret)
 	}
 	if config.SessionEngineOptions == nil {
 		config.SessionEngineOptions = make(SessionEngineOptions)
 	}
 
+	if config.HealthPath == "" {
+		config.HealthPath = "/healthz"
+	}
+	if config.ReadinessPath == "" {
+		config.ReadinessPath = "/readyz"
+	}
+
+	if config.AdminPrefix == "" {
+		config.AdminPrefix = "/debug"
+	}
+
+	if config.OAuthPrefix == "" {
+		config.OAuthPrefix = "/auth"
+	}
+
+	if config.RateLimitStore == "" {
+		config.RateLimitStore = "memory"
+	}
+
 	return config
 }
 
@@ -93,9 +169,75 @@ type ymlTemplate struct {
 	Options TplOptions `yaml:"options,omitempty"`
 }
 
+type ymlHealth struct {
+	Disabled      bool   `yaml:"disabled,omitempty"`
+	Path          string `yaml:"path,omitempty"`
+	ReadinessPath string `yaml:"readypath,omitempty"`
+}
+
+type ymlAdmin struct {
+	Enabled       bool   `yaml:"enabled,omitempty"`
+	Prefix        string `yaml:"prefix,omitempty"`
+	Token         string `yaml:"token,omitempty"`
+	AllowLoopback bool   `yaml:"allowloopback,omitempty"`
+}
+
+type ymlOAuth struct {
+	Prefix    string                    `yaml:"prefix,omitempty"`
+	Providers map[string]*OAuthProvider `yaml:"providers,omitempty"`
+}
+
 type ymlRoute struct {
-	Handler string `yaml:"handler"`
-	Alias   string `yaml:"alias"`
+	Handler     string        `yaml:"handler"`
+	Alias       string        `yaml:"alias"`
+	CORS        *CORSConfig   `yaml:"cors,omitempty"`
+	CSRFExempt  bool          `yaml:"csrfexempt,omitempty"`
+	RateLimit   *RateLimit    `yaml:"ratelimit,omitempty"`
+	WSRateLimit *RateLimit    `yaml:"wsratelimit,omitempty"`
+	BodyLimits  *BodyLimits   `yaml:"limits,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	NoCompress  bool          `yaml:"nocompression,omitempty"`
+	Auth        bool          `yaml:"auth,omitempty"`
+	Roles       []string      `yaml:"roles,omitempty"`
+	Permissions []string      `yaml:"permissions,omitempty"`
+	Signed      bool          `yaml:"signed,omitempty"`
+}
+
+// apply sets route options from yaml route.
+func (r ymlRoute) apply(opts *RouteOptions) {
+	if r.CORS != nil {
+		opts.CORS = r.CORS
+	}
+	if r.CSRFExempt {
+		opts.CSRFExempt = true
+	}
+	if r.RateLimit != nil {
+		opts.RateLimit = r.RateLimit
+	}
+	if r.WSRateLimit != nil {
+		opts.WSRateLimit = r.WSRateLimit
+	}
+	if r.BodyLimits != nil {
+		opts.BodyLimits = r.BodyLimits
+	}
+	if r.Timeout != 0 {
+		opts.Timeout = r.Timeout
+	}
+	if r.NoCompress {
+		opts.DisableCompression = true
+	}
+	if r.Auth {
+		opts.RequireAuth = true
+	}
+	if r.Roles != nil {
+		opts.Roles = r.Roles
+	}
+	if r.Permissions != nil {
+		opts.Permissions = r.Permissions
+	}
+	if r.Signed {
+		opts.Signed = true
+	}
 }
 
 // yamlConf is used to make yaml configuration easiest to write.
@@ -107,6 +249,19 @@ type yamlConf struct {
 	StrictSlash        bool                `yaml:"strictslash,omitempty"`
 	Template           ymlTemplate         `yaml:"template,omitempty"`
 	Session            ymlSession          `yaml:"session,omitempty"`
+	Health             ymlHealth           `yaml:"health,omitempty"`
+	Admin              ymlAdmin            `yaml:"admin,omitempty"`
+	CORS               *CORSConfig         `yaml:"cors,omitempty"`
+	CSRF               *CSRFConfig         `yaml:"csrf,omitempty"`
+	Security           *SecurityConfig     `yaml:"security,omitempty"`
+	RateLimit          *RateLimit          `yaml:"ratelimit,omitempty"`
+	WSRateLimit        *RateLimit          `yaml:"wsratelimit,omitempty"`
+	RateLimitStore     string              `yaml:"ratelimitstore,omitempty"`
+	BodyLimits         *BodyLimits         `yaml:"limits,omitempty"`
+	Timeout            time.Duration       `yaml:"timeout,omitempty"`
+	Compression        *CompressionConfig  `yaml:"compression,omitempty"`
+	OAuth              ymlOAuth            `yaml:"oauth,omitempty"`
+	URLSigningKeys     []string            `yaml:"signingkeys,omitempty"`
 	Routes             map[string]ymlRoute `yaml:"routes"`
 	//DB                 ymlDB               `yaml:"db,omitempty"`
 }
@@ -125,6 +280,25 @@ func (y yamlConf) parse() *Config {
 		TemplateDir:           y.Template.Dir,
 		TemplateEngine:        y.Template.Engine,
 		TemplateEngineOptions: y.Template.Options,
+		DisableHealth:         y.Health.Disabled,
+		HealthPath:            y.Health.Path,
+		ReadinessPath:         y.Health.ReadinessPath,
+		AdminEnabled:          y.Admin.Enabled,
+		AdminPrefix:           y.Admin.Prefix,
+		AdminToken:            y.Admin.Token,
+		AdminAllowLoopback:    y.Admin.AllowLoopback,
+		CORS:                  y.CORS,
+		CSRF:                  y.CSRF,
+		Security:              y.Security,
+		RateLimit:             y.RateLimit,
+		WSRateLimit:           y.WSRateLimit,
+		RateLimitStore:        y.RateLimitStore,
+		BodyLimits:            y.BodyLimits,
+		Timeout:               y.Timeout,
+		Compression:           y.Compression,
+		OAuthPrefix:           y.OAuth.Prefix,
+		OAuthProviders:        y.OAuth.Providers,
+		URLSigningKeys:        y.URLSigningKeys,
 		//DB:                    y.DB.Engine,
 		//DBOptions:             y.DB.Options,
 	}
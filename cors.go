@@ -0,0 +1,212 @@
+package kwiscale
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default methods allowed for cross origin requests.
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+// CORSConfig configures Cross-Origin Resource Sharing. Set it globally with
+// Config.CORS or per route with RouteOptions.CORS.
+//
+// AllowedOrigins accepts:
+//
+//   - "*" to allow any origin
+//   - a complete origin, eg. "https://example.com"
+//   - a wildcard origin, eg. "https://*.example.com"
+//   - a regular expression prefixed by "re:", eg. "re:^https://[a-z]+\.example\.com$"
+//
+// Credentials are never allowed to origins that are only accepted by "*",
+// they receive a literal "*" origin.
+type CORSConfig struct {
+	// Allowed origins, see CORSConfig documentation
+	AllowedOrigins []string `yaml:"origins,omitempty"`
+	// Allowed methods, default is GET, HEAD and POST
+	AllowedMethods []string `yaml:"methods,omitempty"`
+	// Allowed request headers, "*" accepts every requested header
+	AllowedHeaders []string `yaml:"headers,omitempty"`
+	// Headers that the client can read
+	ExposedHeaders []string `yaml:"expose,omitempty"`
+	// Allow cookies and authorization headers
+	AllowCredentials bool `yaml:"credentials,omitempty"`
+	// Number of seconds a preflight response can be cached, 0 to not send header
+	MaxAge int `yaml:"maxage,omitempty"`
+
+	once     sync.Once
+	patterns []*regexp.Regexp
+}
+
+// compile builds regexp from wildcard and regexp origins.
+func (c *CORSConfig) compile() {
+	c.once.Do(func() {
+		if c.AllowCredentials && c.anyOrigin() {
+			Error("CORS credentials are not allowed with \"*\" origin, only listed origins receive them")
+		}
+		for _, o := range c.AllowedOrigins {
+			switch {
+			case strings.HasPrefix(o, "re:"):
+				re, err := regexp.Compile(strings.TrimPrefix(o, "re:"))
+				if err != nil {
+					Error("Bad CORS origin regexp", o, err)
+					continue
+				}
+				c.patterns = append(c.patterns, re)
+			case o != "*" && strings.Contains(o, "*"):
+				parts := strings.Split(o, "*")
+				for i := range parts {
+					parts[i] = regexp.QuoteMeta(parts[i])
+				}
+				c.patterns = append(c.patterns,
+					regexp.MustCompile("^"+strings.Join(parts, "[^/]*")+"$"))
+			}
+		}
+	})
+}
+
+// allowOrigin returns true if origin is allowed.
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	return c.anyOrigin() || c.matchOrigin(origin)
+}
+
+// matchOrigin returns true if origin is allowed by a listed origin, "*" is
+// ignored.
+func (c *CORSConfig) matchOrigin(origin string) bool {
+	c.compile()
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin returns true if "*" is an allowed origin.
+func (c *CORSConfig) anyOrigin() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// methods returns the allowed methods.
+func (c *CORSConfig) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+// allowMethod returns true if method is allowed.
+func (c *CORSConfig) allowMethod(method string) bool {
+	for _, m := range c.methods() {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders returns the headers to send in preflight response, and false
+// if one of the requested headers is not allowed.
+func (c *CORSConfig) allowHeaders(requested string) (string, bool) {
+	if requested == "" {
+		return strings.Join(c.AllowedHeaders, ", "), true
+	}
+	allowed := map[string]bool{}
+	for _, h := range c.AllowedHeaders {
+		if h == "*" {
+			return requested, true
+		}
+		allowed[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h != "" && !allowed[h] {
+			return "", false
+		}
+	}
+	return requested, true
+}
+
+// setOrigin writes origin and credentials headers. Origins that are only
+// allowed by "*" receive "*" without credentials, so any site cannot make
+// credentialed requests.
+func (c *CORSConfig) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin() && (!c.AllowCredentials || !c.matchOrigin(origin)) {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight responds to OPTIONS preflight request. CORS headers are only
+// written if the request is allowed, so the browser refuses the request
+// otherwise.
+func (c *CORSConfig) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers, ok := c.allowHeaders(r.Header.Get("Access-Control-Request-Headers"))
+	if c.allowOrigin(origin) && c.allowMethod(method) && ok {
+		c.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+		if headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cors is the built-in middleware that handles cross origin requests. Route
+// configuration overrides Config.CORS. Preflight requests are answered
+// without calling the handler Options() method.
+func (app *App) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentRoute(r).options.CORS
+		if c == nil {
+			c = app.Config.CORS
+		}
+		origin := r.Header.Get("Origin")
+		if c == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r)
+			return
+		}
+
+		// response depends on origin, even if it is not allowed
+		w.Header().Add("Vary", "Origin")
+		if c.allowOrigin(origin) {
+			c.setOrigin(w.Header(), origin)
+			if len(c.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
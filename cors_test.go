@@ -0,0 +1,112 @@
+package kwiscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Call app with a cross origin request.
+func corsRequest(app *App, method, path, origin string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, "http://example.com"+path, nil)
+	r.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		r.Header.Set("Access-Control-Request-Headers", "x-token")
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+// Test preflight and simple requests with wildcard origin.
+func TestCORS(t *testing.T) {
+	app := NewApp(&Config{
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"https://*.example.com"},
+			AllowedMethods: []string{"GET", "PUT"},
+			AllowedHeaders: []string{"X-Token"},
+			MaxAge:         600,
+		},
+	})
+	app.AddRoute("/foo", &TestHandler{})
+
+	w := corsRequest(app, "OPTIONS", "/foo", "https://api.example.com")
+	if w.Code != http.StatusNoContent {
+		t.Fatal("Preflight should respond 204, got", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://api.example.com" ||
+		w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatal("Bad preflight headers:", w.Header())
+	}
+
+	w = corsRequest(app, "OPTIONS", "/foo", "https://evil.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Origin should not be allowed:", w.Header())
+	}
+
+	w = corsRequest(app, "GET", "/foo", "https://www.example.com")
+	if w.Body.String() != "Hello" || w.Header().Get("Access-Control-Allow-Origin") != "https://www.example.com" {
+		t.Fatal("Bad cross origin response:", w.Header(), w.Body.String())
+	}
+
+	w = corsRequest(app, "GET", "/foo", "https://evil.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "Origin" {
+		t.Fatal("Disallowed origin should only vary on origin:", w.Header())
+	}
+}
+
+// Test that "*" origin never receives credentials.
+func TestCORSCredentials(t *testing.T) {
+	app := NewApp(&Config{
+		CORS: &CORSConfig{
+			AllowedOrigins:   []string{"*", "https://front.example.com"},
+			AllowCredentials: true,
+		},
+	})
+	app.AddRoute("/foo", &TestHandler{})
+
+	w := corsRequest(app, "GET", "/foo", "https://evil.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatal("Any origin should not receive credentials:", w.Header())
+	}
+
+	w = corsRequest(app, "GET", "/foo", "https://front.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://front.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatal("Listed origin should receive credentials:", w.Header())
+	}
+}
+
+// Test that route configuration overrides global configuration.
+func TestCORSRoute(t *testing.T) {
+	app := initApp(t)
+	app.AddNamedRoute("/foo", &TestHandler{}, "foo")
+
+	w := corsRequest(app, "GET", "/foo", "https://front.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS is not configured, no header should be sent:", w.Header())
+	}
+
+	conf := yamlConf{}
+	err := yaml.Unmarshal([]byte(`
+routes:
+  /foo:
+    handler: kwiscale.TestHandler
+    alias: foo
+    cors:
+      origins: ["re:^https://[a-z]+\\.example\\.com$"]
+`), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Routes["/foo"].apply(app.RouteOptions("foo"))
+
+	w = corsRequest(app, "GET", "/foo", "https://front.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://front.example.com" {
+		t.Fatal("Route CORS configuration is not used:", w.Header())
+	}
+}
@@ -0,0 +1,123 @@
+package kwiscale
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+)
+
+// csrfSessionKey is the session key where CSRF token is stored.
+const csrfSessionKey = "_kwiscale_csrf"
+
+// ErrCSRF is returned when CSRF token is missing or invalid.
+var ErrCSRF = errors.New("Invalid CSRF token")
+
+// CSRFConfig enables Cross-Site Request Forgery protection, set it with
+// Config.CSRF. Tokens are kept in session, they are created the first time
+// they are used. Unsafe requests (POST, PUT, PATCH, DELETE) must give the
+// token in a form field or a header.
+//
+// Use "csrf_field" or "csrf_token" functions in templates, or
+// BaseHandler.CSRFToken() in handlers.
+type CSRFConfig struct {
+	// FieldName is the form field name, default is "csrf_token"
+	FieldName string `yaml:"field,omitempty"`
+	// HeaderName is the header to use with AJAX requests, default is "X-CSRF-Token"
+	HeaderName string `yaml:"header,omitempty"`
+}
+
+// fieldName returns the form field name.
+func (c *CSRFConfig) fieldName() string {
+	if c.FieldName == "" {
+		return "csrf_token"
+	}
+	return c.FieldName
+}
+
+// headerName returns the header name.
+func (c *CSRFConfig) headerName() string {
+	if c.HeaderName == "" {
+		return "X-CSRF-Token"
+	}
+	return c.HeaderName
+}
+
+// isSafeMethod returns true for methods that should not change state.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// csrf is the built-in middleware that checks CSRF token on unsafe requests.
+// The token is created in session by csrfToken() when a handler or a
+// template uses it, so that requests that don't show forms don't create
+// sessions.
+func (app *App) csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := app.Config.CSRF
+		options := currentRoute(r).options
+		if c == nil || options.CSRFExempt || options.builtin {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !isSafeMethod(r.Method) {
+			expected, _ := requestSession(r).Get(csrfSessionKey).(string)
+			given := r.Header.Get(c.headerName())
+			if given == "" {
+				given = r.PostFormValue(c.fieldName())
+			}
+			if expected == "" || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+				app.Error(http.StatusForbidden, w, ErrCSRF)
+				return
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), csrfContextKey, true))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the CSRF token of the request session, it is created if
+// it doesn't exist. It returns an empty string if CSRF protection is not
+// enabled for the request.
+func csrfToken(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	if enabled, _ := r.Context().Value(csrfContextKey).(bool); !enabled {
+		return ""
+	}
+	session := requestSession(r)
+	token, _ := session.Get(csrfSessionKey).(string)
+	if token != "" {
+		return token
+	}
+	token = randomToken()
+	if err := session.Set(csrfSessionKey, token); err != nil {
+		Error("Cannot set CSRF token", err)
+		return ""
+	}
+	return token
+}
+
+// csrfField returns the hidden input to put in forms.
+func csrfField(app *App, r *http.Request) template.HTML {
+	if app.Config.CSRF == nil {
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="` +
+		template.HTMLEscapeString(app.Config.CSRF.fieldName()) + `" value="` +
+		template.HTMLEscapeString(csrfToken(r)) + `" />`)
+}
+
+// CSRFToken returns the CSRF token to send back in unsafe requests. It is
+// empty if Config.CSRF is not set.
+func (b *BaseHandler) CSRFToken() string {
+	return csrfToken(b.request)
+}
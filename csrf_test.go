@@ -0,0 +1,82 @@
+package kwiscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A handler that gives the CSRF token and accepts posts.
+type csrfHandler struct{ RequestHandler }
+
+func (h *csrfHandler) Get() {
+	h.WriteString(h.CSRFToken())
+}
+
+func (h *csrfHandler) Post() {
+	h.WriteString("posted")
+}
+
+// Test that unsafe requests need the token given by session.
+func TestCSRF(t *testing.T) {
+	app := NewApp(&Config{CSRF: &CSRFConfig{}})
+	app.AddNamedRoute("/form", &csrfHandler{}, "form")
+	app.AddNamedRoute("/hook", &csrfHandler{}, "hook")
+	app.RouteOptions("hook").CSRFExempt = true
+
+	r, _ := http.NewRequest("GET", "http://example.com/form", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	token := w.Body.String()
+	cookie := w.Header().Get("Set-Cookie")
+	if token == "" || cookie == "" {
+		t.Fatal("CSRF token should be created in session", w.Header())
+	}
+
+	post := func(path string, form url.Values, header string) int {
+		r, _ := http.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", cookie)
+		if header != "" {
+			r.Header.Set("X-CSRF-Token", header)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post("/form", url.Values{}, ""); code != http.StatusForbidden {
+		t.Fatal("Post without token should be forbidden, got", code)
+	}
+	if code := post("/form", url.Values{"csrf_token": {"bad"}}, ""); code != http.StatusForbidden {
+		t.Fatal("Post with bad token should be forbidden, got", code)
+	}
+	if code := post("/form", url.Values{"csrf_token": {token}}, ""); code != http.StatusOK {
+		t.Fatal("Post with form token should be accepted, got", code)
+	}
+	if code := post("/form", url.Values{}, token); code != http.StatusOK {
+		t.Fatal("Post with header token should be accepted, got", code)
+	}
+	if code := post("/hook", url.Values{}, ""); code != http.StatusOK {
+		t.Fatal("Exempted route should accept post without token, got", code)
+	}
+}
+
+// Test that the CSRF token is only created when it is used, probes and
+// pages without form don't create sessions.
+func TestCSRFLazyToken(t *testing.T) {
+	app := NewApp(&Config{CSRF: &CSRFConfig{}})
+	app.AddRoute("/foo", &TestHandler{})
+
+	for _, path := range []string{"/healthz", "/readyz", "/foo"} {
+		w := serve(app, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatal(path, "should respond, got", w.Code)
+		}
+		if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+			t.Fatal(path, "should not create a session:", cookie)
+		}
+	}
+}
@@ -22,10 +22,13 @@ The built-in template allows to override templates. Example:
 	{{ end }}
 
 
-Also, built-in template provides two functions:
+Also, built-in template provides functions:
 
 	- url: gives url of a handler with parameters
 	- static: gives static resource url
+	- csrf_token: gives the CSRF token (if Config.CSRF is set)
+	- csrf_field: gives a hidden input that holds the CSRF token
+	- csp_nonce: gives the Content-Security-Policy nonce (if Config.Security uses it)
 
 Example:
 
@@ -99,6 +102,121 @@ Anyway, you always may use "UserHandler.Vars":  UserHandler.Vars["id"] and UserH
 You may use Init() and Destroy() method that are called before and after HTTP verb invocation. You may, for example, open database connection in "Init" and close the connection in "Destroy".
 
 
+Sessions are kept in a cookie by default. Set Config.SessionEngine to "memory", "file" or "redis" to keep them on server side, the cookie then only holds a signed session id. Options are "ttl" (eg. "30m"), "gcinterval", "dir" for files, and "address", "password", "db", "prefix" and "poolsize" for redis (6.2 or later, instances share sessions safely):
+
+	session:
+	  engine: file
+	  options:
+	    dir: /var/lib/myapp/sessions
+	    ttl: 2h
+
+Sessions expire after "ttl" without access and after "lifetime" since login. Login() gives a new session id to prevent fixation (see RegenerateSession()), CleanSession() removes the session, and server side engines can remove every sessions of a user:
+
+	err := h.InvalidateAllSessions(user.ID)
+
+Every engines read cookie options: "maxage", "domain", "path", "secure", "httponly" and "samesite". The cookie engine may be encrypted with "blockkey", and "oldkeys" lists previous secrets that are still accepted.
+
+Handlers read and change the session with Session(). Middlewares (CSRF, rate limits, SessionAuthenticator) and the handler share it: values are loaded once and the changes are saved once, before the response is written:
+
+	session := h.Session()
+	session.Set("cart", cart)
+	session.Delete("coupon")
+
+Session engines implement BatchSessionStore to load and save values at once, other engines are called for each value.
+
+Values are encoded with gob by default, your own types must then be given to gob.Register(). The "serializer" engine option may be set to "json" or "msgpack" (see RegisterSessionSerializer()), values are then read back with their type with SessionKey:
+
+	var cartKey = kwiscale.SessionKey[Cart]("cart")
+
+	cart, err := cartKey.Get(h.Session())
+
+Saving a value that cannot be encoded gives a SessionEncodingError that names the key.
+
+Websocket messages are queued and written by one goroutine per connection, so Send methods may be called from any goroutine. Room broadcasts don't wait: a client whose queue is full is disconnected.
+
+Clients are in the room named by the request path, they may also join named rooms. Rooms are left when the connection is closed:
+
+	func (h *ChatHandler) OnJSON(i interface{}, err error) {
+		msg := i.(map[string]interface{})
+		h.Join(msg["room"].(string))
+		h.SendJSONToRoom(msg["room"].(string), msg)
+	}
+
+Websocket handlers may change the session in Init() and OnConnect(), which are called before the upgrade: changes are sent with the upgrade response. The session is then a read only snapshot, Session().Set() returns ErrSessionReadOnly.
+
+Flash messages are kept in session until they are rendered, Render() gives them as "Flashes":
+
+	h.AddFlash("success", "Profile saved")
+	h.Redirect("/profile")
+
+	{{ range .Flashes }}<p class="{{ .Kind }}">{{ .Message }}</p>{{ end }}
+
+
+Kwiscale mounts "/healthz" and "/readyz" routes that respond in JSON. The health (liveness) route only tells that the process responds. You may register dependency checks that are called by the readiness route:
+
+	app.AddHealthCheck("database", func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+
+Readiness fails as soon as App.Shutdown() or App.SoftStop() is called. The global rate limit, the global timeout and CSRF protection don't apply to health and admin routes.
+
+Setting Config.AdminEnabled mounts admin routes under Config.AdminPrefix ("/debug" by default): pprof, routes, config, handlers, rooms and runtime. They only respond in debug mode (see SetDebug()), to requests giving Config.AdminToken as "Bearer" authorization. Loopback clients are accepted without token if Config.AdminAllowLoopback is set, don't set it behind a local reverse proxy as every client is then a loopback client.
+
+
+Middlewares can be appended with App.Use(), they wrap the handler of every matched route. Some settings can be changed per route with App.RouteOptions(name), or in the "routes" section of kwiscale.yml. For example, to allow cross origin requests:
+
+	app.RouteOptions("api").CORS = &kwiscale.CORSConfig{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET", "POST", "PUT"},
+	}
+
+Or in kwiscale.yml (use a top level "cors" section to configure every routes):
+
+	routes:
+	  /api/{path:.*}:
+	    handler: handlers.APIHandler
+	    alias: api
+	    cors:
+	      origins: ["https://*.example.com"]
+	      methods: [GET, POST, PUT]
+
+
+Authenticators find the user of each request, handlers get it with User(). Session login (see BaseHandler.Login()), HTTP Basic, API keys and JWT are provided:
+
+	app.AddAuthenticator(
+		kwiscale.NewSessionAuthenticator(findUser),
+		kwiscale.NewJWTAuthenticator([]byte(secret)),
+	)
+	app.RouteOptions("account").RequireAuth = true
+
+In kwiscale.yml, set "auth: true" on the route. Anonymous requests to such routes get a 401 error.
+
+Routes may also require RouteOptions.Roles (one of them) and RouteOptions.Permissions (all of them), "roles" and "permissions" in kwiscale.yml. They are checked before the handler Init(). Handlers can implement Authorizer to add their own rules, it is called after Init() and before the verb method or the websocket upgrade:
+
+	func (h *PostHandler) Authorize(user *kwiscale.User, method string) error {
+		if method != "GET" && (user == nil || user.ID != h.post.Author) {
+			return kwiscale.ErrForbidden
+		}
+		return nil
+	}
+
+OAuth2 and OpenID Connect login use the authorization code flow with PKCE. The user is recorded in session, so add a SessionAuthenticator too:
+
+	app.AddOAuthProvider("google", &kwiscale.OAuthProvider{
+		ClientID:     clientID,
+		ClientSecret: secret,
+		Issuer:       "https://accounts.google.com",
+	})
+
+Links to "/auth/google/login?next=/account" start the login, the provider must redirect to "/auth/google/callback". Handlers get the (refreshed) access token with OAuthToken(). Tokens are only kept by server side session engines ("memory", "file" or "redis"), the cookie engine keeps the login but not the tokens: use OAuthProvider.OnLogin to store them.
+
+App.SignedURL() gives links that cannot be altered, for downloads or email confirmations. Set RouteOptions.Signed ("signed: true" in kwiscale.yml) to refuse requests without a valid signature:
+
+	u, err := app.SignedURL("download", 24*time.Hour, "id", "42")
+
+URLs are signed with the first Config.URLSigningKeys, other keys are still accepted to rotate them. Without keys, a key is derived from Config.SessionSecret; URLs are not signed if it is not set either.
+
+
 Kwiscale provides a CLI:
 
 	go get gopkg.in/framework/kwiscale
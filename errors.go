@@ -9,6 +9,8 @@ import (
 var (
 	// ErrNotFound error type.
 	ErrNotFound = errors.New("Not found")
+	// ErrForbidden error type.
+	ErrForbidden = errors.New("Forbidden")
 	// ErrNotImplemented error type.
 	ErrNotImplemented = errors.New("Not implemented")
 	// ErrInternalError for internal error.
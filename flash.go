@@ -0,0 +1,39 @@
+package kwiscale
+
+import "encoding/json"
+
+// flashSessionKey is the session key that holds flash messages.
+const flashSessionKey = "_kwiscale_flashes"
+
+// Flash is a message shown once, generally on the page that follows a
+// redirection.
+type Flash struct {
+	Kind    string
+	Message string
+}
+
+// AddFlash records a message in session, to be shown on next rendering.
+// Kind is free, eg. "success", "warning" or "error".
+func (b *BaseHandler) AddFlash(kind, msg string) {
+	flashes := append(b.peekFlashes(), Flash{Kind: kind, Message: msg})
+	v, _ := json.Marshal(flashes)
+	b.SetSession(flashSessionKey, string(v))
+}
+
+// Flashes returns the recorded messages and removes them from session.
+func (b *BaseHandler) Flashes() []Flash {
+	flashes := b.peekFlashes()
+	if len(flashes) > 0 {
+		b.Session().Delete(flashSessionKey)
+	}
+	return flashes
+}
+
+// peekFlashes returns the recorded messages, they are kept in session.
+func (b *BaseHandler) peekFlashes() []Flash {
+	flashes := []Flash{}
+	if v, ok := b.Session().Get(flashSessionKey).(string); ok {
+		json.Unmarshal([]byte(v), &flashes)
+	}
+	return flashes
+}
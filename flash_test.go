@@ -0,0 +1,56 @@
+package kwiscale
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A handler that adds flash messages then redirects.
+type flashPostHandler struct{ RequestHandler }
+
+func (h *flashPostHandler) Get() {
+	h.AddFlash("success", "Saved")
+	h.AddFlash("warning", "Check your email")
+	h.Redirect("/show")
+}
+
+// A handler that renders flash messages.
+type flashShowHandler struct{ RequestHandler }
+
+func (h *flashShowHandler) Get() {
+	h.Render("flash.html", nil)
+}
+
+// Test that flash messages are rendered once after a redirection.
+func TestFlash(t *testing.T) {
+	d := t.TempDir()
+	tpl := `{{ range .Flashes }}{{ .Kind }}:{{ .Message }};{{ end }}`
+	if err := os.WriteFile(filepath.Join(d, "flash.html"), []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(&Config{TemplateDir: d})
+	T[app] = t
+	app.AddRoute("/save", &flashPostHandler{})
+	app.AddRoute("/show", &flashShowHandler{})
+
+	w := serve(app, "/save", nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatal("Handler should redirect, got", w.Code)
+	}
+	c := w.Result().Cookies()[0]
+	cookie := http.Header{"Cookie": {c.Name + "=" + c.Value}}
+
+	w = serve(app, "/show", cookie)
+	if w.Body.String() != "success:Saved;warning:Check your email;" {
+		t.Fatal("Flashes are not rendered, got", w.Body.String())
+	}
+
+	// flashes are removed from session
+	c = w.Result().Cookies()[0]
+	cookie = http.Header{"Cookie": {c.Name + "=" + c.Value}}
+	if w := serve(app, "/show", cookie); w.Body.String() != "" {
+		t.Fatal("Flashes should be shown once, got", w.Body.String())
+	}
+}
@@ -5,8 +5,10 @@ import "reflect"
 // handlerManager is used to manage handler production.
 type handlerManager struct {
 
-	// the handler type to produce
-	handler string
+	// the handler name and type to produce, the type is kept here so
+	// producers don't read the registry while handlers are registered
+	handler     string
+	handlerType reflect.Type
 
 	// record closers
 	closer chan int
@@ -19,10 +21,10 @@ type handlerManager struct {
 func (manager handlerManager) newWebHandler() WebHandler {
 	defer func() {
 		if err := recover(); err != nil {
-			Error(err, handlerRegistry)
+			Error(err, manager.handler)
 		}
 	}()
-	return reflect.New(handlerRegistry[manager.handler]).Interface().(WebHandler)
+	return reflect.New(manager.handlerType).Interface().(WebHandler)
 }
 
 // produce returns the producer chan.
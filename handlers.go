@@ -98,6 +98,9 @@ func (r *RequestHandler) Status(status int) {
 // Render calls assigned template engine Render method.
 // This method copies globalCtx and write ctx inside. So, contexts are not overriden, it
 // only merge 2 context in a new one that is passed to template.
+//
+// The Content-Security-Policy nonce is given as "CSPNonce" if Config.Security
+// uses it, and flash messages are given as "Flashes" (see AddFlash()).
 func (r *RequestHandler) Render(file string, ctx map[string]interface{}) error {
 	// merge global context with the given
 	// ctx should override gobal context
@@ -105,6 +108,12 @@ func (r *RequestHandler) Render(file string, ctx map[string]interface{}) error {
 	for k, v := range r.GlobalCtx() {
 		newctx[k] = v
 	}
+	if nonce := r.CSPNonce(); nonce != "" {
+		newctx["CSPNonce"] = nonce
+	}
+	if _, ok := ctx["Flashes"]; !ok {
+		newctx["Flashes"] = r.Flashes()
+	}
 	for k, v := range ctx {
 		newctx[k] = v
 	}
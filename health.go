@@ -0,0 +1,140 @@
+package kwiscale
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckTimeout is the maximum duration given to the whole set of
+// health checks to respond.
+var HealthCheckTimeout = 5 * time.Second
+
+// HealthCheck is a function that returns an error if the checked
+// resource is not healthy.
+type HealthCheck func(ctx context.Context) error
+
+// healthCheck is a named HealthCheck.
+type healthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// healthResult is the status of one check.
+type healthResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthReport is the JSON response of health and readiness routes.
+type healthReport struct {
+	Status string                  `json:"status"`
+	Reason string                  `json:"reason,omitempty"`
+	Checks map[string]healthResult `json:"checks,omitempty"`
+}
+
+// AddHealthCheck registers a named check that is called by the readiness
+// route. If a check with the same name exists, it is replaced.
+func (app *App) AddHealthCheck(name string, check HealthCheck) {
+	app.healthLock.Lock()
+	defer app.healthLock.Unlock()
+	for i, c := range app.healthChecks {
+		if c.name == name {
+			app.healthChecks[i].check = check
+			return
+		}
+	}
+	app.healthChecks = append(app.healthChecks, healthCheck{name, check})
+}
+
+// Ready returns false if the application is shutting down or if handler
+// production was stopped with SoftStop().
+func (app *App) Ready() bool {
+	return atomic.LoadInt32(&app.shuttingDown) == 0 &&
+		atomic.LoadInt32(&app.stopped) == 0
+}
+
+// runHealthChecks calls every checks concurrently and returns the results
+// and true if every check passed.
+func (app *App) runHealthChecks(ctx context.Context) (map[string]healthResult, bool) {
+	app.healthLock.RLock()
+	checks := make([]healthCheck, len(app.healthChecks))
+	copy(checks, app.healthChecks)
+	app.healthLock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	var (
+		results = make(map[string]healthResult, len(checks))
+		healthy = true
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			res := healthResult{Status: "ok"}
+			if err := c.check(ctx); err != nil {
+				res = healthResult{Status: "fail", Error: err.Error()}
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			results[c.name] = res
+			if res.Status != "ok" {
+				healthy = false
+			}
+		}(c)
+	}
+	wg.Wait()
+	return results, healthy
+}
+
+// writeHealth writes the report in JSON with the given status.
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	b, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// healthHandler responds to liveness probes. It only tells that the process
+// serves requests, dependencies are checked by the readiness route so that
+// an outage doesn't restart the application.
+type healthHandler struct{ RequestHandler }
+
+// Get writes the health report.
+func (h *healthHandler) Get() {
+	writeHealth(h.response, healthReport{Status: "ok"})
+}
+
+// readinessHandler responds to readiness probes. It fails when the
+// application is shutting down, or if one health check fails.
+type readinessHandler struct{ RequestHandler }
+
+// Get writes the readiness report.
+func (h *readinessHandler) Get() {
+	report := healthReport{Status: "ok"}
+	switch {
+	case atomic.LoadInt32(&h.app.shuttingDown) == 1:
+		report.Status, report.Reason = "fail", "shutting down"
+	case atomic.LoadInt32(&h.app.stopped) == 1:
+		report.Status, report.Reason = "fail", "handlers stopped"
+	default:
+		checks, ok := h.app.runHealthChecks(h.request.Context())
+		if !ok {
+			report.Status = "fail"
+		}
+		report.Checks = checks
+	}
+	writeHealth(h.response, report)
+}
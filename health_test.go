@@ -0,0 +1,100 @@
+package kwiscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Call path on app and decode the health report.
+func getHealth(t *testing.T, app *App, path string) (int, healthReport) {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	report := healthReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal("Health response is not JSON:", w.Body.String(), err)
+	}
+	return w.Code, report
+}
+
+// Test that checks are called by readiness, liveness ignores them.
+func TestHealthChecks(t *testing.T) {
+	app := initApp(t)
+
+	app.AddHealthCheck("db", func(context.Context) error { return nil })
+	code, report := getHealth(t, app, "/readyz")
+	if code != http.StatusOK || report.Checks["db"].Status != "ok" {
+		t.Fatal("Readiness should be ok, got", code, report)
+	}
+
+	app.AddHealthCheck("cache", func(context.Context) error { return errors.New("down") })
+	code, report = getHealth(t, app, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("Readiness should fail, got", code)
+	}
+	if report.Checks["cache"].Error != "down" {
+		t.Fatal("Check error is not reported:", report)
+	}
+
+	code, report = getHealth(t, app, "/healthz")
+	if code != http.StatusOK || report.Checks != nil {
+		t.Fatal("Liveness should not call checks, got", code, report)
+	}
+}
+
+// Test that Shutdown may be called while the server starts.
+func TestShutdownRace(t *testing.T) {
+	app := initApp(t)
+	done := make(chan struct{})
+	go func() {
+		app.ListenAndServe("127.0.0.1:0")
+		close(done)
+	}()
+	app.Shutdown(context.Background())
+	<-done
+}
+
+// Test that readiness fails on shutdown.
+func TestReadiness(t *testing.T) {
+	app := initApp(t)
+
+	code, _ := getHealth(t, app, "/readyz")
+	if code != http.StatusOK {
+		t.Fatal("Application should be ready, got", code)
+	}
+
+	app.Shutdown(context.Background())
+	code, report := getHealth(t, app, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Reason != "shutting down" {
+		t.Fatal("Application should not be ready while shutting down, got", code, report)
+	}
+}
+
+// Test that probes are not limited by the global rate limit, timeout and
+// CSRF protection.
+func TestHealthBuiltinRoute(t *testing.T) {
+	app := NewApp(&Config{
+		RateLimit: &RateLimit{Requests: 1, Period: time.Minute},
+		Timeout:   time.Nanosecond,
+		CSRF:      &CSRFConfig{},
+	})
+	app.AddRoute("/foo", &TestHandler{})
+
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			if code, _ := getHealth(t, app, path); code != http.StatusOK {
+				t.Fatal(path, "should not be limited, got", code)
+			}
+		}
+	}
+	serve(app, "/foo", nil)
+	if w := serve(app, "/foo", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatal("Global rate limit should apply to other routes, got", w.Code)
+	}
+}
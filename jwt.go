@@ -0,0 +1,271 @@
+package kwiscale
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	// hash functions used by JWT algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+var (
+	// ErrInvalidToken is returned when a JWT is malformed or its signature
+	// is not valid.
+	ErrInvalidToken = errors.New("Invalid token")
+	// ErrTokenExpired is returned when a JWT is expired or not yet valid.
+	ErrTokenExpired = errors.New("Token expired")
+)
+
+// hashes used by JWT algorithms.
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// parseJWT checks the token signature with the key returned by keyFor, and
+// returns the claims. Supported algorithms are HS256/384/512 ([]byte key)
+// and RS256/384/512 (*rsa.PublicKey). Claims are not validated.
+func parseJWT(token string, keyFor func(jwtHeader) (interface{}, error)) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(header.Alg) != 5 {
+		return nil, ErrInvalidToken
+	}
+	hash, ok := jwtHashes[header.Alg[2:]]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := keyFor(header)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok || len(secret) == 0 {
+			return nil, ErrInvalidToken
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrInvalidToken
+		}
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		h := hash.New()
+		h.Write(signed)
+		if rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig) != nil {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64 JSON part of a token.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// validateClaims checks exp, nbf, iss and aud claims. Issuer and audience
+// are not checked if they are empty.
+func validateClaims(claims map[string]interface{}, issuer, audience string, leeway time.Duration) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-leeway)) {
+		return ErrTokenExpired
+	}
+	if iss, _ := claims["iss"].(string); issuer != "" && iss != issuer {
+		return ErrInvalidToken
+	}
+	if audience != "" && !hasAudience(claims["aud"], audience) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// hasAudience returns true if aud claim (string or list) contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings returns a claim as a list of strings. Strings are split on
+// spaces (as the OAuth2 "scope" claim).
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		res := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// userFromClaims is the default user mapping: "sub" is the ID, "name" the
+// Name, "roles" the Roles, and "permissions" or "scope" the Permissions.
+func userFromClaims(claims map[string]interface{}) (*User, error) {
+	user := &User{Claims: claims}
+	user.ID, _ = claims["sub"].(string)
+	if user.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	user.Name, _ = claims["name"].(string)
+	user.Roles = claimStrings(claims["roles"])
+	user.Permissions = claimStrings(claims["permissions"])
+	if user.Permissions == nil {
+		user.Permissions = claimStrings(claims["scope"])
+	}
+	return user, nil
+}
+
+// JWTAuthenticator checks JSON Web Tokens given in "Authorization: Bearer"
+// header. Tokens are verified with local keys.
+type JWTAuthenticator struct {
+	// Key verifies tokens: a []byte secret for HS256/384/512 or a
+	// *rsa.PublicKey for RS256/384/512
+	Key interface{}
+	// Keys are used instead of Key for tokens with a "kid" header
+	Keys map[string]interface{}
+	// Issuer and Audience, if set, must match "iss" and "aud" claims
+	Issuer   string
+	Audience string
+	// Leeway accepted on "exp" and "nbf" claims
+	Leeway time.Duration
+	// User builds the user from claims, default uses "sub", "name",
+	// "roles" and "permissions" (or "scope") claims
+	User func(claims map[string]interface{}) (*User, error)
+}
+
+// NewJWTAuthenticator returns a JWTAuthenticator that verifies tokens with
+// key.
+func NewJWTAuthenticator(key interface{}) *JWTAuthenticator {
+	return &JWTAuthenticator{Key: key}
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*User, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		// no token, or not a JWT
+		return nil, nil
+	}
+	claims, err := parseJWT(token, a.key)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateClaims(claims, a.Issuer, a.Audience, a.Leeway); err != nil {
+		return nil, err
+	}
+	if a.User != nil {
+		return a.User(claims)
+	}
+	return userFromClaims(claims)
+}
+
+// key returns the key to verify a token.
+func (a *JWTAuthenticator) key(h jwtHeader) (interface{}, error) {
+	if h.Kid != "" && a.Keys != nil {
+		if key, ok := a.Keys[h.Kid]; ok {
+			return key, nil
+		}
+		return nil, ErrInvalidToken
+	}
+	if a.Key == nil {
+		return nil, ErrInvalidToken
+	}
+	return a.Key, nil
+}
+
+func (a *JWTAuthenticator) challenge() string {
+	return "Bearer"
+}
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key (PKIX or PKCS1),
+// or the public key of a certificate.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return pub, nil
+}
@@ -0,0 +1,175 @@
+package kwiscale
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMaxMemory is the default size of multipart form kept in memory,
+// the rest is stored in temporary files.
+const defaultMaxMemory = 32 << 20
+
+var (
+	// ErrRequestTooLarge is returned when body or uploaded files exceed limits.
+	ErrRequestTooLarge = errors.New("Request entity too large")
+	// ErrUnsupportedMediaType is returned when an uploaded file type is not allowed.
+	ErrUnsupportedMediaType = errors.New("Unsupported media type")
+	// ErrBadRequest is returned when request cannot be parsed.
+	ErrBadRequest = errors.New("Bad request")
+	// ErrPathTraversal is returned when a path tries to reach a parent directory.
+	ErrPathTraversal = errors.New("Path traversal is not allowed")
+)
+
+// BodyLimits constrains request body and uploaded files. Set them globally
+// with Config.BodyLimits or per route with RouteOptions.BodyLimits (route
+// limits replace global limits).
+type BodyLimits struct {
+	// MaxBodySize is the maximum body size in bytes, 0 for no limit
+	MaxBodySize int64 `yaml:"maxbodysize,omitempty"`
+	// MaxMultipartMemory is the size of multipart form kept in memory, default is 32MB
+	MaxMultipartMemory int64 `yaml:"maxmemory,omitempty"`
+	// AllowedTypes are accepted MIME types for files, eg. "image/png" or "image/*"
+	AllowedTypes []string `yaml:"types,omitempty"`
+	// AllowedExtensions are accepted file extensions, eg. ".png"
+	AllowedExtensions []string `yaml:"extensions,omitempty"`
+	// MaxFiles is the maximum number of uploaded files, 0 for no limit
+	MaxFiles int `yaml:"maxfiles,omitempty"`
+}
+
+// maxMemory returns the multipart memory size.
+func (l *BodyLimits) maxMemory() int64 {
+	if l == nil || l.MaxMultipartMemory <= 0 {
+		return defaultMaxMemory
+	}
+	return l.MaxMultipartMemory
+}
+
+// hasFileRules returns true if uploaded files must be checked.
+func (l *BodyLimits) hasFileRules() bool {
+	return l.MaxFiles > 0 || len(l.AllowedTypes) > 0 || len(l.AllowedExtensions) > 0
+}
+
+// allowType returns true if the MIME type matches an allowed type.
+func (l *BodyLimits) allowType(mimetype string) bool {
+	if len(l.AllowedTypes) == 0 {
+		return true
+	}
+	mimetype, _, _ = mime.ParseMediaType(mimetype)
+	for _, t := range l.AllowedTypes {
+		if t == mimetype || t == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mimetype, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowExtension returns true if the filename extension is allowed.
+func (l *BodyLimits) allowExtension(filename string) bool {
+	if len(l.AllowedExtensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range l.AllowedExtensions {
+		if strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFiles parses multipart form and checks uploaded files. It returns
+// the http status and error to respond, or 0 if files are accepted. The
+// form is parsed here so that middlewares that read form values (CSRF)
+// don't parse it with the default memory size.
+func (l *BodyLimits) checkFiles(r *http.Request) (int, error) {
+	if err := r.ParseMultipartForm(l.maxMemory()); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, ErrRequestTooLarge
+		}
+		return http.StatusBadRequest, ErrBadRequest
+	}
+	if !l.hasFileRules() {
+		return 0, nil
+	}
+
+	count := 0
+	for _, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			count++
+			if l.MaxFiles > 0 && count > l.MaxFiles {
+				return http.StatusRequestEntityTooLarge, ErrRequestTooLarge
+			}
+			if !l.allowExtension(fh.Filename) {
+				return http.StatusUnsupportedMediaType, ErrUnsupportedMediaType
+			}
+
+			// detect type from content, do not trust the given one
+			f, err := fh.Open()
+			if err != nil {
+				return http.StatusBadRequest, ErrBadRequest
+			}
+			head := make([]byte, 512)
+			n, _ := f.Read(head)
+			f.Close()
+			if !l.allowType(http.DetectContentType(head[:n])) {
+				return http.StatusUnsupportedMediaType, ErrUnsupportedMediaType
+			}
+		}
+	}
+	return 0, nil
+}
+
+// bodyLimits returns the limits of the request route.
+func (app *App) bodyLimits(r *http.Request) *BodyLimits {
+	if l := currentRoute(r).options.BodyLimits; l != nil {
+		return l
+	}
+	return app.Config.BodyLimits
+}
+
+// bodyLimit is the built-in middleware that limits body size and checks
+// uploaded files. It responds with 413 or 415 status.
+func (app *App) bodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := app.bodyLimits(r)
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if l.MaxBodySize > 0 {
+			if r.ContentLength > l.MaxBodySize {
+				app.Error(http.StatusRequestEntityTooLarge, w, ErrRequestTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+		}
+
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if ct == "multipart/form-data" && (l.MaxMultipartMemory > 0 || l.hasFileRules()) {
+			if status, err := l.checkFiles(r); err != nil {
+				app.Error(status, w, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkPath returns ErrPathTraversal if path has a ".." element.
+func checkPath(path string) error {
+	for _, p := range strings.Split(filepath.ToSlash(path), "/") {
+		if p == ".." {
+			return ErrPathTraversal
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package kwiscale
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A handler that saves uploaded file.
+type uploadHandler struct{ RequestHandler }
+
+func (h *uploadHandler) Post() {
+	if err := h.SavePostFile("file", "../escaped.txt"); err != ErrPathTraversal {
+		h.Error(http.StatusInternalServerError, "path traversal is not refused")
+		return
+	}
+	h.WriteString(string(h.Payload()))
+}
+
+// A handler that tells where the uploaded file is kept.
+type memoryUploadHandler struct{ RequestHandler }
+
+func (h *memoryUploadHandler) Get() {
+	h.WriteString(h.CSRFToken())
+}
+
+func (h *memoryUploadHandler) Post() {
+	f, _, err := h.GetPostFile("file")
+	if err != nil {
+		h.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer f.Close()
+	if _, ok := f.(*os.File); ok {
+		h.WriteString("disk")
+		return
+	}
+	h.WriteString("memory")
+}
+
+// Build a multipart request with one file and form values.
+func uploadRequest(filename, content string, values ...url.Values) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, v := range values {
+		for k := range v {
+			mw.WriteField(k, v.Get(k))
+		}
+	}
+	fw, _ := mw.CreateFormFile("file", filename)
+	fw.Write([]byte(content))
+	mw.Close()
+	r, _ := http.NewRequest("POST", "http://example.com/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// Test body size and upload constraints.
+func TestBodyLimits(t *testing.T) {
+	app := initApp(t)
+	app.AddNamedRoute("/upload", &uploadHandler{}, "upload")
+	app.RouteOptions("upload").BodyLimits = &BodyLimits{
+		MaxBodySize:       1024,
+		AllowedTypes:      []string{"text/*"},
+		AllowedExtensions: []string{".txt"},
+	}
+
+	r, _ := http.NewRequest("POST", "http://example.com/upload", strings.NewReader(strings.Repeat("a", 2048)))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("Large body should be refused, got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, uploadRequest("image.png", "\x89PNG\r\n\x1a\n"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatal("Extension should be refused, got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, uploadRequest("image.txt", "\x89PNG\r\n\x1a\n"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatal("PNG content should be refused, got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, uploadRequest("notes.txt", "hello"))
+	if w.Code != http.StatusOK {
+		t.Fatal("Text file should be accepted, got", w.Code, w.Body.String())
+	}
+}
+
+// Test that the multipart memory limit is used when the form is read by
+// CSRF protection before the handler.
+func TestMultipartMemoryCSRF(t *testing.T) {
+	app := NewApp(&Config{CSRF: &CSRFConfig{}})
+	T[app] = t
+	app.AddNamedRoute("/upload", &memoryUploadHandler{}, "memupload")
+	app.RouteOptions("memupload").BodyLimits = &BodyLimits{MaxMultipartMemory: 100}
+
+	w := serve(app, "/upload", nil)
+	token := w.Body.String()
+	r := uploadRequest("big.txt", strings.Repeat("a", 1024), url.Values{"csrf_token": {token}})
+	r.Header["Cookie"] = sessionCookie(t, w)["Cookie"]
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "disk" {
+		t.Fatal("Large file should be kept on disk, got", w.Code, w.Body.String())
+	}
+}
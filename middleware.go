@@ -0,0 +1,107 @@
+package kwiscale
+
+import (
+	"net/http"
+	"time"
+)
+
+// Middleware wraps the handler that serves a matched route. Middlewares are
+// called in the order they were appended with App.Use(), after built-in
+// middlewares (security headers, CORS, rate limits, signed URLs, body limits,
+// authentication, CSRF, compression, timeout).
+type Middleware func(http.Handler) http.Handler
+
+// RouteOptions are per route settings. They override the App Config for the
+// route they are set on. Use App.RouteOptions() to get them, or set them
+// in the "routes" section of configuration file.
+type RouteOptions struct {
+	// CORS configuration for the route
+	CORS *CORSConfig
+	// CSRFExempt disables CSRF protection for the route
+	CSRFExempt bool
+	// RateLimit for the route, it applies in addition to Config.RateLimit
+	RateLimit *RateLimit
+	// WSRateLimit limits websocket messages, it overrides Config.WSRateLimit
+	WSRateLimit *RateLimit
+	// BodyLimits for the route, it overrides Config.BodyLimits
+	BodyLimits *BodyLimits
+	// Timeout for the route, it overrides Config.Timeout (use a negative
+	// value to disable the global timeout)
+	Timeout time.Duration
+	// DisableCompression disables response compression for the route
+	DisableCompression bool
+	// RequireAuth responds 401 if the request has no authenticated user
+	RequireAuth bool
+	// Roles accepted on the route, the user must have one of them
+	Roles []string
+	// Permissions the user must have on the route
+	Permissions []string
+	// Signed refuses requests that are not made with a valid App.SignedURL()
+	Signed bool
+
+	// builtin is set on health and admin routes, global rate limit, global
+	// timeout and CSRF protection don't apply to them
+	builtin bool
+}
+
+// context key type for route information.
+type contextKey int
+
+const (
+	routeContextKey contextKey = iota
+	csrfContextKey
+	nonceContextKey
+	userContextKey
+	sessionContextKey
+)
+
+// routeContext holds the matched route information in request context.
+type routeContext struct {
+	name    string
+	options *RouteOptions
+}
+
+// Use appends middlewares that are called for every matched route.
+func (app *App) Use(m ...Middleware) {
+	app.middlewares = append(app.middlewares, m...)
+}
+
+// chain wraps h with every middleware.
+func (app *App) chain(h http.Handler) http.Handler {
+	for i := len(app.middlewares) - 1; i >= 0; i-- {
+		h = app.middlewares[i](h)
+	}
+	return h
+}
+
+// RouteOptions returns the options of the route named "name", they are
+// created if they don't exist. Name is the alias given to AddNamedRoute()
+// or the handler name.
+func (app *App) RouteOptions(name string) *RouteOptions {
+	app.routeOptionsLock.Lock()
+	defer app.routeOptionsLock.Unlock()
+	if _, ok := app.routeOptions[name]; !ok {
+		app.routeOptions[name] = &RouteOptions{}
+	}
+	return app.routeOptions[name]
+}
+
+// getRouteOptions returns the route options or empty options if there
+// is none for the route.
+func (app *App) getRouteOptions(name string) *RouteOptions {
+	app.routeOptionsLock.RLock()
+	defer app.routeOptionsLock.RUnlock()
+	if o, ok := app.routeOptions[name]; ok {
+		return o
+	}
+	return &RouteOptions{}
+}
+
+// currentRoute returns the route information stored in request context. It
+// never returns nil.
+func currentRoute(r *http.Request) *routeContext {
+	if rc, ok := r.Context().Value(routeContextKey).(*routeContext); ok {
+		return rc
+	}
+	return &routeContext{options: &RouteOptions{}}
+}
@@ -0,0 +1,391 @@
+package kwiscale
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// MsgpackSerializer encodes session values with MessagePack, it is smaller
+// than JSON and keys may be of any basic type. Values are decoded as
+// generic types (int64, uint64, float64, string, []byte, bool,
+// []interface{} and maps), named types are encoded as their kind.
+// Structures and types that implement json.Marshaler or
+// encoding.TextMarshaler are encoded as JSON would do. Complex numbers,
+// channels and functions are refused. Use SessionKey to get values with
+// their type.
+type MsgpackSerializer struct{}
+
+// Serialize encodes values with MessagePack.
+func (MsgpackSerializer) Serialize(src interface{}) ([]byte, error) {
+	values, err := sessionMap(src)
+	if err != nil {
+		return nil, err
+	}
+	encode := func(values map[interface{}]interface{}) error {
+		return msgpackEncode(&bytes.Buffer{}, values)
+	}
+	buf := &bytes.Buffer{}
+	if err := msgpackEncode(buf, values); err != nil {
+		return nil, encodingError("msgpack", values, err, encode)
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decodes values with MessagePack.
+func (MsgpackSerializer) Deserialize(src []byte, dst interface{}) error {
+	v, err := msgpackDecode(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	values := map[interface{}]interface{}{}
+	switch m := v.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			values[k] = v
+		}
+	case map[interface{}]interface{}:
+		values = m
+	default:
+		return fmt.Errorf("msgpack: values are %T, not a map", v)
+	}
+	return setSessionMap(dst, values)
+}
+
+// msgpackEncode writes v in MessagePack format.
+func msgpackEncode(w *bytes.Buffer, v interface{}) error {
+	if v == nil {
+		w.WriteByte(0xc0)
+		return nil
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+		return nil
+	case string:
+		msgpackHeader(w, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		w.WriteString(v)
+		return nil
+	case []byte:
+		msgpackHeader(w, len(v), 0, 0, 0xc4, 0xc5, 0xc6)
+		w.Write(v)
+		return nil
+	}
+
+	switch v.(type) {
+	case json.Marshaler, encoding.TextMarshaler:
+		return msgpackJSON(w, v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return msgpackEncode(w, rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		msgpackInt(w, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			w.WriteByte(0xcf)
+			binary.Write(w, binary.BigEndian, u)
+		} else {
+			msgpackInt(w, int64(u))
+		}
+	case reflect.Float32:
+		w.WriteByte(0xca)
+		binary.Write(w, binary.BigEndian, float32(rv.Float()))
+	case reflect.Float64:
+		w.WriteByte(0xcb)
+		binary.Write(w, binary.BigEndian, rv.Float())
+	case reflect.String:
+		return msgpackEncode(w, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			w.WriteByte(0xc0)
+			return nil
+		}
+		// byte slices are binary, byte arrays are arrays as with JSON
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return msgpackEncode(w, rv.Bytes())
+		}
+		msgpackHeader(w, rv.Len(), 0x90, 16, 0, 0xdc, 0xdd)
+		for i := 0; i < rv.Len(); i++ {
+			if err := msgpackEncode(w, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			w.WriteByte(0xc0)
+			return nil
+		}
+		msgpackHeader(w, rv.Len(), 0x80, 16, 0, 0xde, 0xdf)
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := msgpackEncode(w, iter.Key().Interface()); err != nil {
+				return err
+			}
+			if err := msgpackEncode(w, iter.Value().Interface()); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			w.WriteByte(0xc0)
+			return nil
+		}
+		return msgpackEncode(w, rv.Elem().Interface())
+	case reflect.Struct:
+		return msgpackJSON(w, v)
+	default:
+		// complex numbers, channels, functions and unsafe pointers
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// msgpackJSON writes v as JSON would encode it.
+func msgpackJSON(w *bytes.Buffer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return msgpackEncode(w, generic)
+}
+
+// msgpackHeader writes the type and length of a string, binary, array or
+// map. fix is the fixed format prefix (if fixMax > 0), codes are the 8, 16
+// and 32 bits formats (0 if the format doesn't exist).
+func msgpackHeader(w *bytes.Buffer, n int, fix byte, fixMax int, c8, c16, c32 byte) {
+	switch {
+	case n < fixMax:
+		w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint8 && c8 != 0:
+		w.WriteByte(c8)
+		w.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(c16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(c32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackInt writes an integer in the smallest format.
+func msgpackInt(w *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		w.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		w.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		w.WriteByte(0xd0)
+		w.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		w.WriteByte(0xd1)
+		binary.Write(w, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		w.WriteByte(0xd2)
+		binary.Write(w, binary.BigEndian, int32(i))
+	default:
+		w.WriteByte(0xd3)
+		binary.Write(w, binary.BigEndian, i)
+	}
+}
+
+// errMsgpackFormat is returned for unknown formats.
+var errMsgpackFormat = errors.New("msgpack: unsupported format")
+
+// msgpackDecode reads a value in MessagePack format. Maps with string keys
+// are returned as map[string]interface{}.
+func msgpackDecode(r *bytes.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return msgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return msgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		b, err := msgpackBytes(r, int(c&0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := msgpackLength(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackBytes(r, n)
+	case 0xca:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return f, err
+	case 0xcc:
+		var i uint8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xcd:
+		var i uint16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xce:
+		var i uint32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xcf:
+		var i uint64
+		err := binary.Read(r, binary.BigEndian, &i)
+		if i <= math.MaxInt64 {
+			return int64(i), err
+		}
+		return i, err
+	case 0xd0:
+		var i int8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := msgpackLength(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		b, err := msgpackBytes(r, n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := msgpackLength(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := msgpackLength(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return msgpackMap(r, n)
+	}
+	return nil, errMsgpackFormat
+}
+
+// msgpackLength reads a length of 8 (size 0), 16 (1) or 32 (2) bits.
+func msgpackLength(r *bytes.Reader, size byte) (int, error) {
+	switch size {
+	case 0:
+		b, err := r.ReadByte()
+		return int(b), err
+	case 1:
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	case 2:
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	}
+	return 0, errMsgpackFormat
+}
+
+// msgpackBytes reads n bytes.
+func msgpackBytes(r *bytes.Reader, n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// msgpackArray reads n values.
+func msgpackArray(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+// msgpackMap reads n pairs, keys must be comparable.
+func msgpackMap(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := make(map[interface{}]interface{}, n)
+	strings := true
+	for i := 0; i < n; i++ {
+		k, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := msgpackDecode(r)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case []interface{}, map[string]interface{}, map[interface{}]interface{}, []byte:
+			return nil, fmt.Errorf("msgpack: map key of type %T is not supported", k)
+		case string:
+		default:
+			strings = false
+		}
+		m[k] = v
+	}
+	if !strings {
+		return m, nil
+	}
+	sm := make(map[string]interface{}, n)
+	for k, v := range m {
+		sm[k.(string)] = v
+	}
+	return sm, nil
+}
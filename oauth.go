@@ -0,0 +1,611 @@
+package kwiscale
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session keys used by OAuth login.
+const (
+	oauthStateSessionKey = "_kwiscale_oauth_state"
+	oauthTokenSessionKey = "_kwiscale_oauth_token"
+)
+
+var (
+	// ErrOAuthState is returned when the callback state doesn't match the
+	// login request.
+	ErrOAuthState = errors.New("Invalid OAuth state")
+	// ErrNoToken is returned when there is no OAuth token in session.
+	ErrNoToken = errors.New("No OAuth token")
+)
+
+// OAuthProvider configures an OAuth2 authorization code login, with PKCE.
+// If Issuer is set, endpoints are discovered from the OpenID configuration
+// and ID tokens are verified with the provider JWKS. Add providers with
+// App.AddOAuthProvider() or in the "oauth" section of kwiscale.yml.
+type OAuthProvider struct {
+	ClientID     string `yaml:"clientid"`
+	ClientSecret string `yaml:"secret,omitempty"`
+	// RedirectURL is the absolute callback URL, default is built from the
+	// request host and Config.OAuthPrefix
+	RedirectURL string `yaml:"redirect,omitempty"`
+	// Scopes to ask, default is "openid profile email" if Issuer is set
+	Scopes []string `yaml:"scopes,omitempty"`
+
+	// Issuer is the OpenID Connect issuer URL
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// Endpoints, they are discovered if Issuer is set
+	AuthURL     string `yaml:"authurl,omitempty"`
+	TokenURL    string `yaml:"tokenurl,omitempty"`
+	JWKSURL     string `yaml:"jwksurl,omitempty"`
+	UserInfoURL string `yaml:"userinfourl,omitempty"`
+
+	// User builds the user from ID token (or userinfo) claims, default
+	// uses "sub", "name", "roles" and "permissions" claims
+	User func(claims map[string]interface{}) (*User, error) `yaml:"-"`
+	// OnLogin is called after a successful login, before the user is
+	// recorded in session. Return an error to refuse the login.
+	OnLogin func(user *User, token *OAuthToken) error `yaml:"-"`
+	// Client is the http client to call provider, default is
+	// http.DefaultClient
+	Client *http.Client `yaml:"-"`
+
+	name string
+	lock sync.Mutex
+	// discovered is true when endpoints are read from OpenID configuration
+	discovered bool
+	keys       map[string]*rsa.PublicKey
+	// fetched is the time of the last JWKS fetch, unknownKids are kids that
+	// were not in JWKS with the time they were looked up
+	fetched     time.Time
+	unknownKids map[string]time.Time
+}
+
+const (
+	// jwksRefetchInterval is the minimum time between two JWKS fetches for
+	// unknown kids.
+	jwksRefetchInterval = time.Minute
+	// jwksUnknownKidTTL is the time an unknown kid is refused without
+	// fetching JWKS again.
+	jwksUnknownKidTTL = 10 * time.Minute
+	// jwksMaxUnknownKids limits the unknown kids cache.
+	jwksMaxUnknownKids = 100
+)
+
+// OAuthToken is the token given by provider. It is kept in session by
+// server side session engines only, without the ID token.
+type OAuthToken struct {
+	Provider     string    `json:"provider"`
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Expired returns true if the token expires in less than 30 seconds.
+func (t *OAuthToken) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().Add(30*time.Second).After(t.Expiry)
+}
+
+// oauthLogin is the OAuth login kept in session. Token is only kept by
+// server side session engines, a cookie would expose the refresh token to
+// the client and exceed the cookie size.
+type oauthLogin struct {
+	Provider string      `json:"provider"`
+	Subject  string      `json:"sub"`
+	Expiry   time.Time   `json:"expiry,omitempty"`
+	Token    *OAuthToken `json:"token,omitempty"`
+}
+
+// oauthState is kept in session between login and callback.
+type oauthState struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// AddOAuthProvider registers the provider as "name". Login starts at
+// Config.OAuthPrefix + "/<name>/login" (use "next" query parameter to set
+// the page to go after login) and the provider redirects to
+// Config.OAuthPrefix + "/<name>/callback".
+//
+// With the cookie session engine, tokens are not kept and OAuthToken()
+// returns ErrNoToken, use OnLogin to store them.
+func (app *App) AddOAuthProvider(name string, p *OAuthProvider) {
+	p.name = name
+	app.oauthLock.Lock()
+	defer app.oauthLock.Unlock()
+	if app.oauthProviders == nil {
+		if _, ok := app.sessionstore.(*CookieSessionStore); ok {
+			Error("OAuth tokens are not kept with the cookie session engine, use OnLogin to store them")
+		}
+		app.oauthProviders = make(map[string]*OAuthProvider)
+		prefix := strings.TrimRight(app.Config.OAuthPrefix, "/")
+		app.AddNamedRoute(prefix+"/{provider}/{action:login|callback}", &oauthHandler{}, "kwiscale-oauth")
+	}
+	app.oauthProviders[name] = p
+}
+
+// oauthProvider returns the provider registered as name, or nil.
+func (app *App) oauthProvider(name string) *OAuthProvider {
+	app.oauthLock.RLock()
+	defer app.oauthLock.RUnlock()
+	return app.oauthProviders[name]
+}
+
+// client returns the http client to call provider.
+func (p *OAuthProvider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+// discover reads endpoints from the OpenID configuration of Issuer, it is
+// done once.
+func (p *OAuthProvider) discover() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Issuer == "" || p.discovered {
+		return nil
+	}
+
+	var conf struct {
+		AuthURL     string `json:"authorization_endpoint"`
+		TokenURL    string `json:"token_endpoint"`
+		JWKSURL     string `json:"jwks_uri"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+	}
+	u := strings.TrimRight(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(u, &conf); err != nil {
+		return err
+	}
+	// endpoints set by user are kept
+	if p.AuthURL == "" {
+		p.AuthURL = conf.AuthURL
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = conf.TokenURL
+	}
+	if p.JWKSURL == "" {
+		p.JWKSURL = conf.JWKSURL
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = conf.UserInfoURL
+	}
+	p.discovered = true
+	return nil
+}
+
+// getJSON decodes the response of a GET request.
+func (p *OAuthProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client().Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responds %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// redirectURL returns the callback URL.
+func (p *OAuthProvider) redirectURL(app *App, r *http.Request) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	prefix := strings.TrimRight(app.Config.OAuthPrefix, "/")
+	return scheme + "://" + r.Host + prefix + "/" + p.name + "/callback"
+}
+
+// scopes returns the scopes to ask.
+func (p *OAuthProvider) scopes() []string {
+	if len(p.Scopes) == 0 && p.Issuer != "" {
+		return []string{"openid", "profile", "email"}
+	}
+	return p.Scopes
+}
+
+// exchange calls the token endpoint with form values.
+func (p *OAuthProvider) exchange(form url.Values) (*OAuthToken, error) {
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Error        string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || res.Error != "" {
+		return nil, fmt.Errorf("token endpoint responds %s %s", resp.Status, res.Error)
+	}
+
+	token := &OAuthToken{
+		Provider:     p.name,
+		AccessToken:  res.AccessToken,
+		TokenType:    res.TokenType,
+		RefreshToken: res.RefreshToken,
+		IDToken:      res.IDToken,
+	}
+	if res.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// Refresh returns a new token using the refresh token.
+func (p *OAuthProvider) Refresh(token *OAuthToken) (*OAuthToken, error) {
+	if token.RefreshToken == "" {
+		return nil, errors.New("token cannot be refreshed")
+	}
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	t, err := p.exchange(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// providers may not send again refresh and id tokens
+	if t.RefreshToken == "" {
+		t.RefreshToken = token.RefreshToken
+	}
+	if t.IDToken == "" {
+		t.IDToken = token.IDToken
+	}
+	return t, nil
+}
+
+// VerifyIDToken checks the ID token signature with provider JWKS, and its
+// issuer, audience and expiry. Claims are returned.
+func (p *OAuthProvider) VerifyIDToken(idToken string) (map[string]interface{}, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	claims, err := parseJWT(idToken, p.jwk)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateClaims(claims, p.Issuer, p.ClientID, time.Minute); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// jwk returns the JWKS key for the token header. Keys are fetched again if
+// kid is unknown, to follow key rotation, but at most once per
+// jwksRefetchInterval. Unknown kids are remembered for jwksUnknownKidTTL,
+// so that forged tokens don't make the provider be called.
+func (p *OAuthProvider) jwk(h jwtHeader) (interface{}, error) {
+	if !strings.HasPrefix(h.Alg, "RS") {
+		return nil, ErrInvalidToken
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if key := p.knownKey(h.Kid); key != nil {
+		return key, nil
+	}
+	now := time.Now()
+	if t, ok := p.unknownKids[h.Kid]; ok && now.Sub(t) < jwksUnknownKidTTL {
+		return nil, ErrInvalidToken
+	}
+	if now.Sub(p.fetched) < jwksRefetchInterval {
+		return nil, ErrInvalidToken
+	}
+	if err := p.fetchKeys(); err != nil {
+		return nil, err
+	}
+	p.fetched = now
+	if key := p.knownKey(h.Kid); key != nil {
+		return key, nil
+	}
+	if p.unknownKids == nil || len(p.unknownKids) >= jwksMaxUnknownKids {
+		p.unknownKids = make(map[string]time.Time)
+	}
+	p.unknownKids[h.Kid] = now
+	return nil, ErrInvalidToken
+}
+
+// knownKey returns the fetched key of kid, or nil. Tokens without kid are
+// accepted if there is only one key. Lock must be held.
+func (p *OAuthProvider) knownKey(kid string) *rsa.PublicKey {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// fetchKeys reads RSA keys from JWKSURL, lock must be held.
+func (p *OAuthProvider) fetchKeys() error {
+	if p.JWKSURL == "" {
+		return errors.New("no JWKS url for provider " + p.name)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.JWKSURL, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	// kids may be known now
+	p.unknownKids = nil
+	return nil
+}
+
+// userClaims returns the claims of the logged in user, from ID token or
+// from userinfo endpoint.
+func (p *OAuthProvider) userClaims(token *OAuthToken, nonce string) (map[string]interface{}, error) {
+	if token.IDToken != "" {
+		claims, err := p.VerifyIDToken(token.IDToken)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return nil, ErrInvalidToken
+		}
+		return claims, nil
+	}
+
+	if p.UserInfoURL == "" {
+		return nil, errors.New("provider " + p.name + " gives no ID token and has no userinfo url")
+	}
+	req, err := http.NewRequest("GET", p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint responds %s", resp.Status)
+	}
+	claims := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&claims)
+	return claims, err
+}
+
+// oauthHandler serves login and callback routes of OAuth providers.
+type oauthHandler struct{ RequestHandler }
+
+// Get dispatches login and callback.
+func (h *oauthHandler) Get() {
+	p := h.app.oauthProvider(h.Vars["provider"])
+	if p == nil {
+		h.app.Error(http.StatusNotFound, h.response, ErrNotFound, h.request.URL)
+		return
+	}
+	if err := p.discover(); err != nil {
+		Error("OAuth discovery failed", p.name, err)
+		h.app.Error(http.StatusBadGateway, h.response, err)
+		return
+	}
+	if h.Vars["action"] == "login" {
+		h.login(p)
+	} else {
+		h.callback(p)
+	}
+}
+
+// login records state in session and redirects to provider.
+func (h *oauthHandler) login(p *OAuthProvider) {
+	state := oauthState{
+		Provider: p.name,
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Next:     localPath(h.request.URL.Query().Get("next")),
+	}
+	b, _ := json.Marshal(state)
+	h.SetSession(oauthStateSessionKey, string(b))
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURL(h.app, h.request)},
+		"state":                 {state.State},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if scopes := p.scopes(); len(scopes) > 0 {
+		q.Set("scope", strings.Join(scopes, " "))
+	}
+	q.Set("nonce", state.Nonce)
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	h.RedirectWithStatus(p.AuthURL+sep+q.Encode(), http.StatusFound)
+}
+
+// callback checks state, exchanges the code and logs in the user.
+func (h *oauthHandler) callback(p *OAuthProvider) {
+	var state oauthState
+	value, _ := h.GetSession(oauthStateSessionKey)
+	s, _ := value.(string)
+	h.SetSession(oauthStateSessionKey, "")
+
+	q := h.request.URL.Query()
+	if s == "" || json.Unmarshal([]byte(s), &state) != nil ||
+		state.Provider != p.name || state.State == "" || q.Get("state") != state.State {
+		h.app.Error(http.StatusUnauthorized, h.response, ErrOAuthState)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		h.app.Error(http.StatusUnauthorized, h.response, ErrUnauthorized, e, q.Get("error_description"))
+		return
+	}
+
+	token, err := p.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {p.redirectURL(h.app, h.request)},
+		"code_verifier": {state.Verifier},
+	})
+	if err != nil {
+		Error("OAuth token exchange failed", p.name, err)
+		h.app.Error(http.StatusUnauthorized, h.response, ErrUnauthorized)
+		return
+	}
+
+	claims, err := p.userClaims(token, state.Nonce)
+	var user *User
+	if err == nil {
+		if p.User != nil {
+			user, err = p.User(claims)
+		} else {
+			user, err = userFromClaims(claims)
+		}
+	}
+	if err == nil && p.OnLogin != nil {
+		err = p.OnLogin(user, token)
+	}
+	if err != nil {
+		Log("OAuth login refused", p.name, err)
+		h.app.Error(http.StatusUnauthorized, h.response, ErrUnauthorized)
+		return
+	}
+
+	h.saveOAuthLogin(&oauthLogin{
+		Provider: p.name,
+		Subject:  user.ID,
+		Expiry:   token.Expiry,
+		Token:    token,
+	})
+	h.Login(user)
+
+	next := state.Next
+	if next == "" {
+		next = "/"
+	}
+	h.RedirectWithStatus(next, http.StatusFound)
+}
+
+// localPath returns path if it is a local absolute path, otherwise an
+// empty string. It prevents open redirects.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return ""
+	}
+	return path
+}
+
+// saveOAuthLogin records login in session. The token is removed with the
+// cookie session engine, and the ID token is never kept.
+func (b *BaseHandler) saveOAuthLogin(login *oauthLogin) {
+	if _, ok := b.sessionStore.(*CookieSessionStore); ok || login.Token == nil {
+		login.Token = nil
+	} else {
+		token := *login.Token
+		token.IDToken = ""
+		login.Token = &token
+	}
+	v, _ := json.Marshal(login)
+	b.SetSession(oauthTokenSessionKey, string(v))
+}
+
+// OAuthToken returns the OAuth token of the logged in user. The token is
+// refreshed if it is expired. ErrNoToken is returned with the cookie
+// session engine, that doesn't keep tokens.
+func (b *BaseHandler) OAuthToken() (*OAuthToken, error) {
+	value, _ := b.GetSession(oauthTokenSessionKey)
+	s, _ := value.(string)
+	if s == "" {
+		return nil, ErrNoToken
+	}
+	login := &oauthLogin{}
+	if err := json.Unmarshal([]byte(s), login); err != nil {
+		return nil, err
+	}
+	if login.Token == nil {
+		return nil, ErrNoToken
+	}
+	if !login.Token.Expired() {
+		return login.Token, nil
+	}
+
+	p := b.app.oauthProvider(login.Provider)
+	if p == nil {
+		return nil, errors.New("unknown OAuth provider " + login.Provider)
+	}
+	token, err := p.Refresh(login.Token)
+	if err != nil {
+		return nil, err
+	}
+	login.Token, login.Expiry = token, token.Expiry
+	b.saveOAuthLogin(login)
+	return token, nil
+}
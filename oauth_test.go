@@ -0,0 +1,257 @@
+package kwiscale
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider is an in process OpenID Connect provider.
+type fakeProvider struct {
+	*httptest.Server
+	t     *testing.T
+	key   *rsa.PrivateKey
+	lock  sync.Mutex
+	codes map[string]url.Values
+	// jwksFetches counts JWKS requests
+	jwksFetches int
+}
+
+// newFakeProvider starts a provider that knows the user "erin".
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{t: t, key: key, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.lock.Lock()
+		p.jwksFetches++
+		p.lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// authorize simulates the user consent, it returns a code for the
+// authorization request.
+func (p *fakeProvider) authorize(location string) (code, state string) {
+	u, err := url.Parse(location)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	q := u.Query()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	code = randomToken()
+	p.codes[code] = q
+	return code, q.Get("state")
+}
+
+// token serves the token endpoint.
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	res := map[string]interface{}{"token_type": "Bearer"}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		p.lock.Lock()
+		q, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.lock.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+			q.Get("redirect_uri") != r.PostForm.Get("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		res["access_token"] = "access-1"
+		res["refresh_token"] = "refresh-1"
+		res["expires_in"] = 1
+		res["id_token"] = signJWT(p.t, "RS256", p.key, map[string]interface{}{
+			"iss":   p.URL,
+			"aud":   q.Get("client_id"),
+			"sub":   "erin",
+			"nonce": q.Get("nonce"),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}, "k1")
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != "refresh-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		res["access_token"] = "access-2"
+		res["expires_in"] = 3600
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// A handler that writes the OAuth access token.
+type oauthTokenHandler struct{ RequestHandler }
+
+func (h *oauthTokenHandler) Get() {
+	token, err := h.OAuthToken()
+	if err != nil {
+		h.WriteString(err.Error())
+		return
+	}
+	h.WriteString(token.AccessToken)
+}
+
+// oauthApp returns an app with a fake provider, and a function that sends
+// requests with the session cookie.
+func oauthApp(t *testing.T, provider *fakeProvider, engine string) (*App, func(string) *httptest.ResponseRecorder) {
+	app := NewApp(&Config{SessionEngine: engine})
+	T[app] = t
+	app.AddNamedRoute("/private", &userHandler{}, "private")
+	app.RouteOptions("private").RequireAuth = true
+	app.AddAuthenticator(NewSessionAuthenticator(nil))
+	app.AddOAuthProvider("fake", &OAuthProvider{ClientID: "kwiscale", Issuer: provider.URL})
+	app.AddRoute("/token", &oauthTokenHandler{})
+
+	cookie := ""
+	return app, func(path string) *httptest.ResponseRecorder {
+		w := serve(app, path, http.Header{"Cookie": {cookie}})
+		if c := w.Result().Cookies(); len(c) > 0 {
+			cookie = c[len(c)-1].Name + "=" + c[len(c)-1].Value
+		}
+		return w
+	}
+}
+
+// Test the authorization code flow with PKCE, ID token verification and
+// token refresh.
+func TestOAuthLogin(t *testing.T) {
+	provider := newFakeProvider(t)
+	defer provider.Close()
+	_, get := oauthApp(t, provider, "memory")
+
+	w := get("/auth/fake/login?next=/private")
+	if w.Code != http.StatusFound {
+		t.Fatal("Login should redirect to provider, got", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	u, _ := url.Parse(location)
+	if u.Query().Get("redirect_uri") != "http://example.com/auth/fake/callback" ||
+		u.Query().Get("code_challenge_method") != "S256" {
+		t.Fatal("Bad authorization request", location)
+	}
+
+	code, state := provider.authorize(location)
+	if w := get("/auth/fake/callback?code=" + code + "&state=bad"); w.Code != http.StatusUnauthorized {
+		t.Fatal("Bad state should be refused, got", w.Code)
+	}
+
+	// state is removed after a callback, start again
+	code, state = provider.authorize(get("/auth/fake/login?next=/private").Header().Get("Location"))
+	w = get("/auth/fake/callback?code=" + code + "&state=" + state)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private" {
+		t.Fatal("Callback should redirect to next page, got", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+
+	if w := get("/private"); w.Body.String() != "erin" {
+		t.Fatal("User should be logged in, got", w.Code, w.Body.String())
+	}
+
+	// first token expires in 1 second, it is refreshed
+	if w := get("/token"); w.Body.String() != "access-2" {
+		t.Fatal("Token should be refreshed, got", w.Body.String())
+	}
+}
+
+// Test that tokens are not kept in the session cookie.
+func TestOAuthCookieSession(t *testing.T) {
+	provider := newFakeProvider(t)
+	defer provider.Close()
+	_, get := oauthApp(t, provider, "")
+
+	code, state := provider.authorize(get("/auth/fake/login").Header().Get("Location"))
+	w := get("/auth/fake/callback?code=" + code + "&state=" + state)
+	if w.Code != http.StatusFound {
+		t.Fatal("Callback should redirect, got", w.Code, w.Body.String())
+	}
+	if w := get("/private"); w.Body.String() != "erin" {
+		t.Fatal("User should be logged in, got", w.Code, w.Body.String())
+	}
+	if w := get("/token"); w.Body.String() != ErrNoToken.Error() {
+		t.Fatal("Token should not be kept in cookie, got", w.Body.String())
+	}
+}
+
+// Test that open redirects are refused.
+func TestLocalPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/account":            "/account",
+		"//evil.example.com":  "",
+		"/\\evil.example.com": "",
+		"https://example.com": "",
+	} {
+		if p := localPath(path); p != expected {
+			t.Errorf("%q: expected %q, got %q", path, expected, p)
+		}
+	}
+}
+
+// Test that JWKS is not fetched for every unknown kid.
+func TestOAuthUnknownKid(t *testing.T) {
+	server := newFakeProvider(t)
+	defer server.Close()
+	p := &OAuthProvider{JWKSURL: server.URL + "/jwks", name: "fake"}
+	fetches := func() int {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		return server.jwksFetches
+	}
+
+	if _, err := p.jwk(jwtHeader{Alg: "RS256", Kid: "k1"}); err != nil || fetches() != 1 {
+		t.Fatal("Known kid should be found with one fetch, got", err, fetches())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.jwk(jwtHeader{Alg: "RS256", Kid: "forged"}); err != ErrInvalidToken {
+			t.Fatal("Unknown kid should be refused, got", err)
+		}
+	}
+	if fetches() != 1 {
+		t.Fatal("JWKS should not be fetched again before the interval, got", fetches())
+	}
+
+	p.fetched = p.fetched.Add(-jwksRefetchInterval)
+	p.jwk(jwtHeader{Alg: "RS256", Kid: "forged"})
+	if fetches() != 2 {
+		t.Fatal("JWKS should be fetched again after the interval, got", fetches())
+	}
+	p.fetched = p.fetched.Add(-jwksRefetchInterval)
+	p.jwk(jwtHeader{Alg: "RS256", Kid: "forged"})
+	if fetches() != 2 {
+		t.Fatal("Unknown kid should be cached, got", fetches())
+	}
+}
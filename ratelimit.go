@@ -0,0 +1,320 @@
+package kwiscale
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrTooManyRequests is returned when a rate limit is reached.
+var ErrTooManyRequests = errors.New("Too many requests")
+
+// rateLimitSessionKey is the session key that identifies a client session
+// for rate limits.
+const rateLimitSessionKey = "_kwiscale_ratelimit"
+
+// Rate limit algorithms.
+const (
+	// TokenBucket allows bursts up to RateLimit.Burst then refills
+	// RateLimit.Requests tokens per RateLimit.Period.
+	TokenBucket = "tokenbucket"
+	// SlidingWindow allows RateLimit.Requests in any RateLimit.Period.
+	SlidingWindow = "window"
+)
+
+// Rate limit keys.
+const (
+	// ByIP limits requests per client IP address.
+	ByIP = "ip"
+	// BySession limits requests per client session, clients without a
+	// stored session are limited per IP address. The first request of a
+	// session is limited per IP address.
+	BySession = "session"
+	// ByRoute limits the requests on a route, for every clients.
+	ByRoute = "route"
+)
+
+var rateLimitStores = make(map[string]RateLimitStore)
+
+// RegisterRateLimitStore records a RateLimitStore. The name is used to let
+// configuration select it (see Config.RateLimitStore). A registered store is
+// shared by every App that selects it, the built-in "memory" store is
+// created for each App.
+func RegisterRateLimitStore(name string, store RateLimitStore) {
+	rateLimitStores[name] = store
+}
+
+// newRateLimitStore returns the store named in configuration.
+func newRateLimitStore(name string) (RateLimitStore, bool) {
+	if store, ok := rateLimitStores[name]; ok {
+		return store, true
+	}
+	if name == "memory" {
+		return NewMemoryRateLimitStore(), true
+	}
+	return nil, false
+}
+
+// RateLimit configures a limit. Set it globally with Config.RateLimit, or
+// per route with RouteOptions.RateLimit. Websocket message rate is limited
+// per connection with Config.WSRateLimit and RouteOptions.WSRateLimit.
+type RateLimit struct {
+	// Number of requests allowed per Period
+	Requests int `yaml:"requests"`
+	// Period, in yaml use a duration string as "1m" or "30s"
+	Period time.Duration `yaml:"period"`
+	// Burst is the TokenBucket size, default is Requests
+	Burst int `yaml:"burst,omitempty"`
+	// Algorithm is TokenBucket (default) or SlidingWindow
+	Algorithm string `yaml:"algorithm,omitempty"`
+	// By is the limit key: ByIP (default), BySession or ByRoute. It is not
+	// used for websocket messages.
+	By string `yaml:"by,omitempty"`
+}
+
+// RateLimitStore keeps hits for rate limits. Implement it to share limits
+// between several instances.
+type RateLimitStore interface {
+	// Allow records a hit for key and returns true if the limit is not
+	// reached. If it is, the duration to wait before next allowed hit
+	// is returned.
+	Allow(key string, limit *RateLimit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// rateEntry is the state of a key in memory.
+type rateEntry struct {
+	// token bucket
+	tokens float64
+	last   time.Time
+
+	// sliding window
+	start time.Time
+	prev  int
+	curr  int
+}
+
+// allow applies the limit to the entry.
+func (e *rateEntry) allow(limit *RateLimit, now time.Time) (bool, time.Duration) {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return true, 0
+	}
+
+	if limit.Algorithm == SlidingWindow {
+		elapsed := now.Sub(e.start)
+		if elapsed >= limit.Period {
+			e.prev = e.curr
+			if elapsed >= 2*limit.Period {
+				e.prev = 0
+			}
+			e.curr = 0
+			e.start = now.Truncate(limit.Period)
+			elapsed = now.Sub(e.start)
+		}
+		weight := 1 - float64(elapsed)/float64(limit.Period)
+		if float64(e.prev)*weight+float64(e.curr) >= float64(limit.Requests) {
+			return false, limit.Period - elapsed
+		}
+		e.curr++
+		return true, 0
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Requests
+	}
+	rate := float64(limit.Requests) / limit.Period.Seconds()
+	if e.last.IsZero() {
+		e.tokens = float64(burst)
+	} else {
+		e.tokens = math.Min(float64(burst), e.tokens+now.Sub(e.last).Seconds()*rate)
+	}
+	e.last = now
+	if e.tokens < 1 {
+		return false, time.Duration((1 - e.tokens) / rate * float64(time.Second))
+	}
+	e.tokens--
+	return true, 0
+}
+
+// MemoryRateLimitStore keeps hits in memory, it is the default store.
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	entries   map[string]*rateEntry
+	periods   map[string]time.Duration
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		entries:   make(map[string]*rateEntry),
+		periods:   make(map[string]time.Duration),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow implements RateLimitStore.
+func (s *MemoryRateLimitStore) Allow(key string, limit *RateLimit) (bool, time.Duration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &rateEntry{}
+		s.entries[key] = e
+		s.periods[key] = limit.Period
+	}
+	allowed, retry := e.allow(limit, now)
+	return allowed, retry, nil
+}
+
+// sweep removes entries that are not used since 2 periods, once per minute.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		last := e.last
+		if e.start.After(last) {
+			last = e.start
+		}
+		if now.Sub(last) > 2*s.periods[key] {
+			delete(s.entries, key)
+			delete(s.periods, key)
+		}
+	}
+}
+
+// clientIP returns the request remote IP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKey returns the store key for the limit. Clients are limited by
+// session only when the session id was recorded in a stored session, others
+// are limited by IP: anonymous requests don't create sessions and forged
+// cookies don't give a new key.
+func (app *App) rateLimitKey(scope string, limit *RateLimit, r *http.Request) string {
+	switch limit.By {
+	case ByRoute:
+		return scope
+	case BySession:
+		if id := app.rateLimitSessionID(r); id != "" {
+			return scope + ":session:" + id
+		}
+		return scope + ":ip:" + clientIP(r)
+	default:
+		return scope + ":ip:" + clientIP(r)
+	}
+}
+
+// rateLimitSessionID returns the rate limit id recorded in the request
+// session, or an empty string.
+func (app *App) rateLimitSessionID(r *http.Request) string {
+	if _, err := r.Cookie(app.Config.SessionName); err != nil {
+		return ""
+	}
+	id, _ := requestSession(r).Get(rateLimitSessionKey).(string)
+	return id
+}
+
+// bindRateLimitSession records a rate limit id in a valid session that has
+// none, the next requests are limited by session. It is called once the
+// request was allowed by IP.
+func (app *App) bindRateLimitSession(r *http.Request) {
+	if app.rateLimitSessionID(r) != "" {
+		return
+	}
+	if _, err := r.Cookie(app.Config.SessionName); err != nil {
+		return
+	}
+	session := requestSession(r)
+	if !session.stored() {
+		return
+	}
+	if err := session.Set(rateLimitSessionKey, randomToken()); err != nil {
+		Error("Cannot set rate limit session", err)
+	}
+}
+
+// rateLimit is the built-in middleware that applies global and route rate
+// limits. It responds with 429 status and a Retry-After header when a limit
+// is reached. The global limit doesn't apply to built-in routes.
+func (app *App) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := currentRoute(r)
+		global := app.Config.RateLimit
+		if route.options.builtin {
+			global = nil
+		}
+		// global limit is applied first
+		limits := []struct {
+			scope string
+			limit *RateLimit
+		}{
+			{"*", global},
+			{route.name, route.options.RateLimit},
+		}
+		bySession := false
+		for _, l := range limits {
+			scope, limit := l.scope, l.limit
+			if limit == nil {
+				continue
+			}
+			bySession = bySession || limit.By == BySession
+			key := app.rateLimitKey(scope, limit, r)
+			allowed, retry, err := app.rateLimitStore.Allow(key, limit)
+			if err != nil {
+				Error("Rate limit store error", err)
+				continue
+			}
+			if !allowed {
+				seconds := int(math.Ceil(retry.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				app.Error(http.StatusTooManyRequests, w, ErrTooManyRequests)
+				return
+			}
+		}
+		if bySession {
+			app.bindRateLimitSession(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wsLimiter returns a function that returns false when the websocket message
+// rate limit of the connection is reached.
+func wsLimiter(w WSHandler) func() bool {
+	h, ok := w.(WebHandler)
+	if !ok {
+		return func() bool { return true }
+	}
+	limit := currentRoute(h.getRequest()).options.WSRateLimit
+	if limit == nil {
+		limit = h.App().Config.WSRateLimit
+	}
+	if limit == nil {
+		return func() bool { return true }
+	}
+
+	e := &rateEntry{}
+	return func() bool {
+		allowed, _ := e.allow(limit, time.Now())
+		return allowed
+	}
+}
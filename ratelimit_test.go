@@ -0,0 +1,114 @@
+package kwiscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that a route limit responds 429 with Retry-After header.
+func TestRateLimitRoute(t *testing.T) {
+	app := initApp(t)
+	app.AddNamedRoute("/limited", &TestHandler{}, "limited")
+	app.RouteOptions("limited").RateLimit = &RateLimit{
+		Requests: 2,
+		Period:   time.Minute,
+	}
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://example.com/limited", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get("10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatal("Request should be allowed, got", w.Code)
+		}
+	}
+	w := get("10.0.0.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("Request should be limited, got", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Fatal("Retry-After should be 30 seconds, got", w.Header().Get("Retry-After"))
+	}
+
+	if w := get("10.0.0.2"); w.Code != http.StatusOK {
+		t.Fatal("Another client should be allowed, got", w.Code)
+	}
+}
+
+// Test that applications don't share the memory store, and that clients
+// without session are limited by IP without creating a session.
+func TestRateLimitStorePerApp(t *testing.T) {
+	limit := &RateLimit{Requests: 1, Period: time.Minute, By: BySession}
+	get := func(app *App) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		app := NewApp(&Config{RateLimit: limit})
+		app.AddRoute("/foo", &TestHandler{})
+		w := get(app)
+		if w.Code != http.StatusOK {
+			t.Fatal("First request of each app should be allowed, got", w.Code)
+		}
+		if w.Header().Get("Set-Cookie") != "" {
+			t.Fatal("Rate limit should not create a session:", w.Header().Get("Set-Cookie"))
+		}
+		if w := get(app); w.Code != http.StatusTooManyRequests {
+			t.Fatal("Client without session should be limited by IP, got", w.Code)
+		}
+	}
+}
+
+// Test the sliding window algorithm.
+func TestSlidingWindow(t *testing.T) {
+	limit := &RateLimit{Requests: 2, Period: time.Minute, Algorithm: SlidingWindow}
+	e := &rateEntry{}
+	now := time.Now().Truncate(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := e.allow(limit, now); !ok {
+			t.Fatal("Hit should be allowed")
+		}
+	}
+	if ok, retry := e.allow(limit, now.Add(10*time.Second)); ok || retry != 50*time.Second {
+		t.Fatal("Hit should be refused until next window, retry after", retry)
+	}
+
+	// half of the previous window is counted
+	if ok, _ := e.allow(limit, now.Add(90*time.Second)); !ok {
+		t.Fatal("Hit should be allowed in the next window")
+	}
+	if ok, _ := e.allow(limit, now.Add(90*time.Second)); ok {
+		t.Fatal("Hit should be refused, previous window is weighted")
+	}
+}
+
+// Test that clients are limited by session only once the session is
+// stored, a forged session cookie is limited by IP.
+func TestRateLimitForgedSession(t *testing.T) {
+	app := sessionApp(t, "memory", nil)
+	app.Config.RateLimit = &RateLimit{Requests: 2, Period: time.Minute, By: BySession}
+
+	cookie := sessionCookie(t, serve(app, "/set/a/1", nil))
+	if w := serve(app, "/get/a", cookie); w.Code != http.StatusOK {
+		t.Fatal("Second request should be allowed by IP, got", w.Code)
+	}
+	if w := serve(app, "/get/a", cookie); w.Code != http.StatusOK {
+		t.Fatal("Stored session should be limited by session, got", w.Code)
+	}
+
+	forged := http.Header{"Cookie": {app.Config.SessionName + "=forged"}}
+	if w := serve(app, "/get/a", forged); w.Code != http.StatusTooManyRequests {
+		t.Fatal("Forged session should be limited by IP, got", w.Code)
+	}
+}
@@ -0,0 +1,354 @@
+package kwiscale
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisRetries is the number of attempts of a transaction when the session
+// is changed by another client.
+const redisRetries = 10
+
+// ErrRedisConflict is returned when a session cannot be updated because
+// other clients keep changing it.
+var ErrRedisConflict = errors.New("redis: session changed concurrently")
+
+// Register redis session engine.
+func init() {
+	RegisterSessionEngine("redis", NewRedisSessionStore())
+}
+
+// RedisSessionStore keeps sessions in a Redis server (or any server that
+// speaks Redis protocol), to share them between several instances. It is
+// registered as "redis" session engine. Options are:
+//
+//	address:    server address, default is "localhost:6379"
+//	password:   AUTH password
+//	db:         database number
+//	prefix:     keys prefix, default is "kwiscale:session:"
+//	ttl:        session lifetime since last access, eg. "30m" (default "24h")
+//	poolsize:   maximum number of connections, default is 10
+//	serializer: "gob" (default), "json", "msgpack" or a registered serializer
+//
+// With gob, use gob.Register() for your own types. Sessions are updated in
+// WATCH/MULTI/EXEC transactions, instances don't lose each other's writes.
+// Redis 6.2 or later is needed (GETEX command).
+type RedisSessionStore struct {
+	serverSessionStore
+	prefix string
+	pool   *redisPool
+}
+
+// NewRedisSessionStore returns a redis session store, connections are
+// opened when needed.
+func NewRedisSessionStore() *RedisSessionStore {
+	s := &RedisSessionStore{}
+	s.backend = s
+	s.SetOptions(nil)
+	return s
+}
+
+// SetOptions reads connection and session options.
+func (s *RedisSessionStore) SetOptions(opts SessionEngineOptions) {
+	s.setOptions(opts)
+	s.prefix = "kwiscale:session:"
+	if prefix, ok := opts["prefix"].(string); ok {
+		s.prefix = prefix
+	}
+
+	if s.pool != nil {
+		s.pool.close()
+	}
+	s.pool = &redisPool{address: "localhost:6379", timeout: 5 * time.Second}
+	if address, ok := opts["address"].(string); ok && address != "" {
+		s.pool.address = address
+	}
+	s.pool.password, _ = opts["password"].(string)
+	s.pool.db = optionInt(opts, "db", 0)
+	size := optionInt(opts, "poolsize", 10)
+	if size <= 0 {
+		size = 10
+	}
+	s.pool.idle = make(chan *redisConn, size)
+	s.pool.sem = make(chan struct{}, size)
+}
+
+// Init starts the collector of user indexes cache, redis removes expired
+// sessions itself.
+func (s *RedisSessionStore) Init() {
+	s.serverSessionStore.Init()
+}
+
+// load reads the session, GETEX extends its lifetime since it is accessed.
+func (s *RedisSessionStore) load(id string, ttl time.Duration) (sessionValues, error) {
+	reply, err := s.pool.do("GETEX", s.prefix+id, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	content, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.New("unexpected redis reply")
+	}
+	return s.decode(content)
+}
+
+func (s *RedisSessionStore) save(id string, values sessionValues) error {
+	content, err := s.encode(values)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.do("SET", s.prefix+id, string(content), "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	return err
+}
+
+// transaction saves the values returned by apply. The key is watched while
+// it is read, the transaction is retried if another client changed it.
+func (s *RedisSessionStore) transaction(id string, ttl time.Duration, apply func(sessionValues) sessionValues) error {
+	for i := 0; i < redisRetries; i++ {
+		c, err := s.pool.get()
+		if err != nil {
+			return err
+		}
+		done, err := s.watchAndSet(c, s.prefix+id, ttl, apply)
+		if err != nil {
+			// the connection may be left in a transaction
+			s.pool.discard(c)
+			return err
+		}
+		s.pool.release(c, nil)
+		if done {
+			return nil
+		}
+		// let the other client finish
+		time.Sleep(time.Duration(rand.Int63n(int64(i+1) * int64(time.Millisecond))))
+	}
+	return ErrRedisConflict
+}
+
+// watchAndSet runs one transaction on c, it returns false if the key was
+// changed by another client.
+func (s *RedisSessionStore) watchAndSet(c *redisConn, key string, ttl time.Duration, apply func(sessionValues) sessionValues) (bool, error) {
+	timeout := s.pool.timeout
+	if _, err := c.do(timeout, "WATCH", key); err != nil {
+		return false, err
+	}
+	reply, err := c.do(timeout, "GET", key)
+	if err != nil {
+		return false, err
+	}
+	var values sessionValues
+	if content, ok := reply.([]byte); ok {
+		// unreadable values are replaced
+		values, _ = s.decode(content)
+	}
+	content, err := s.encode(apply(values))
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := c.do(timeout, "MULTI"); err != nil {
+		return false, err
+	}
+	if _, err := c.do(timeout, "SET", key, string(content), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		return false, err
+	}
+	reply, err = c.do(timeout, "EXEC")
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		// aborted, the key was changed
+		return false, nil
+	}
+	if res, ok := reply.([]interface{}); !ok || len(res) != 1 || res[0] != "OK" {
+		return false, errors.New("unexpected redis reply")
+	}
+	return true, nil
+}
+
+func (s *RedisSessionStore) delete(id string) error {
+	_, err := s.pool.do("DEL", s.prefix+id)
+	return err
+}
+
+func (s *RedisSessionStore) gc(time.Duration) {}
+
+// redisError is an error replied by server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to server.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// ErrRedisPoolTimeout is returned when every connections of the pool are
+// used for longer than the timeout.
+var ErrRedisPoolTimeout = errors.New("redis: connection pool timeout")
+
+// redisPool keeps idle connections, sem limits open connections.
+type redisPool struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+	sem      chan struct{}
+}
+
+// get returns an idle connection or opens a new one. It waits for a free
+// connection until the pool timeout.
+func (p *redisPool) get() (*redisConn, error) {
+	wait := time.NewTimer(p.timeout)
+	defer wait.Stop()
+	select {
+	case p.sem <- struct{}{}:
+	case <-wait.C:
+		return nil, ErrRedisPoolTimeout
+	}
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", p.address, p.timeout)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	// a connection that is not authenticated or on the wrong database must
+	// not be reused
+	fail := func(err error) (*redisConn, error) {
+		p.discard(c)
+		return nil, err
+	}
+	if p.password != "" {
+		if _, err := c.do(p.timeout, "AUTH", p.password); err != nil {
+			return fail(err)
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do(p.timeout, "SELECT", strconv.Itoa(p.db)); err != nil {
+			return fail(err)
+		}
+	}
+	return c, nil
+}
+
+// release puts back the connection in pool, or closes it after a network
+// error.
+func (p *redisPool) release(c *redisConn, err error) {
+	if _, ok := err.(redisError); err != nil && !ok {
+		p.discard(c)
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	<-p.sem
+}
+
+// discard closes a connection that must not be reused.
+func (p *redisPool) discard(c *redisConn) {
+	c.conn.Close()
+	<-p.sem
+}
+
+// do sends a command and returns the reply.
+func (p *redisPool) do(args ...string) (interface{}, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(p.timeout, args...)
+	p.release(c, err)
+	return reply, err
+}
+
+// close closes idle connections.
+func (p *redisPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do writes a command and reads the reply.
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// readRESP reads a reply in Redis protocol. Bulk strings are returned as
+// []byte, integers as int64 and arrays as []interface{}.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: bad reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, n)
+		for i := range res {
+			if res[i], err = readRESP(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return res, nil
+	}
+	return nil, errors.New("redis: bad reply")
+}
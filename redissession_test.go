@@ -0,0 +1,341 @@
+package kwiscale
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in process server that speaks enough Redis protocol for
+// the session store.
+type fakeRedis struct {
+	net.Listener
+	lock    sync.Mutex
+	data    map[string]string
+	expires map[string]time.Time
+	// versions are changed with keys, for WATCH
+	versions map[string]int
+	// password required by AUTH, and number of AUTH to reject
+	password     string
+	authFailures int
+}
+
+// newFakeRedis starts a server on a random port.
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		Listener: l,
+		data:     map[string]string{},
+		expires:  map[string]time.Time{},
+		versions: map[string]int{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve reads commands from a connection.
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	s.lock.Lock()
+	authenticated := s.password == ""
+	s.lock.Unlock()
+	// watched key versions and queued commands of a transaction
+	var watched map[string]int
+	var queue [][]string
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, a := range reply.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = s.auth(args)
+			if !authenticated {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required\r\n")
+		case strings.ToUpper(args[0]) == "WATCH":
+			watched = s.watch(watched, args[1:])
+			fmt.Fprint(conn, "+OK\r\n")
+		case strings.ToUpper(args[0]) == "UNWATCH":
+			watched = nil
+			fmt.Fprint(conn, "+OK\r\n")
+		case strings.ToUpper(args[0]) == "MULTI":
+			queue = [][]string{}
+			fmt.Fprint(conn, "+OK\r\n")
+		case strings.ToUpper(args[0]) == "DISCARD":
+			queue, watched = nil, nil
+			fmt.Fprint(conn, "+OK\r\n")
+		case strings.ToUpper(args[0]) == "EXEC":
+			fmt.Fprint(conn, s.transaction(watched, queue))
+			queue, watched = nil, nil
+		case queue != nil:
+			queue = append(queue, args)
+			fmt.Fprint(conn, "+QUEUED\r\n")
+		default:
+			fmt.Fprint(conn, s.exec(args))
+		}
+	}
+}
+
+// auth checks the AUTH password.
+func (s *fakeRedis) auth(args []string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.authFailures > 0 {
+		s.authFailures--
+		return false
+	}
+	return len(args) == 2 && args[1] == s.password
+}
+
+// watch adds the current versions of keys to watched.
+func (s *fakeRedis) watch(watched map[string]int, keys []string) map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if watched == nil {
+		watched = map[string]int{}
+	}
+	for _, k := range keys {
+		s.expire(k)
+		watched[k] = s.versions[k]
+	}
+	return watched
+}
+
+// transaction runs queued commands if watched keys didn't change.
+func (s *fakeRedis) transaction(watched map[string]int, queue [][]string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, v := range watched {
+		s.expire(k)
+		if s.versions[k] != v {
+			return "*-1\r\n"
+		}
+	}
+	replies := fmt.Sprintf("*%d\r\n", len(queue))
+	for _, args := range queue {
+		replies += s.run(args)
+	}
+	return replies
+}
+
+// expire removes key if it is expired, lock must be held.
+func (s *fakeRedis) expire(key string) {
+	if e, ok := s.expires[key]; ok && time.Now().After(e) {
+		delete(s.data, key)
+		delete(s.expires, key)
+		s.versions[key]++
+	}
+}
+
+// exec runs a command and returns the encoded reply.
+func (s *fakeRedis) exec(args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.run(args)
+}
+
+// run runs a command, lock must be held.
+func (s *fakeRedis) run(args []string) string {
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		s.expire(key)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := s.data[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "GETEX":
+		v, ok := s.data[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			s.versions[key]++
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		s.versions[key]++
+		s.data[key] = args[2]
+		delete(s.expires, key)
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "PEXPIRE":
+		if _, ok := s.data[key]; !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		s.versions[key]++
+		return ":1\r\n"
+	case "DEL":
+		_, ok := s.data[key]
+		delete(s.data, key)
+		delete(s.expires, key)
+		s.versions[key]++
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// keys returns the stored keys.
+func (s *fakeRedis) keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Test the redis session engine.
+func TestRedisSession(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	app := sessionApp(t, "redis", SessionEngineOptions{
+		"address":  server.Addr().String(),
+		"prefix":   "test:",
+		"poolsize": 4,
+		"ttl":      "1h",
+	})
+	testSessionEngine(t, app)
+
+	keys := server.keys()
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "test:") {
+		t.Fatal("One session should be stored with prefix, got", keys)
+	}
+}
+
+// Test that sessions expire with ttl.
+func TestRedisSessionTTL(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	app := sessionApp(t, "redis", SessionEngineOptions{
+		"address": server.Addr().String(),
+		"ttl":     "50ms",
+	})
+	w := serve(app, "/set/a/1", nil)
+	c := w.Result().Cookies()[0]
+	time.Sleep(100 * time.Millisecond)
+	if w := serve(app, "/get/a", map[string][]string{"Cookie": {c.Name + "=" + c.Value}}); w.Body.String() != "-" {
+		t.Fatal("Session should be expired, got", w.Body.String())
+	}
+}
+
+// Test that a connection that fails AUTH is not reused.
+func TestRedisAuthFailure(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+	server.lock.Lock()
+	server.password = "secret"
+	server.authFailures = 1
+	server.lock.Unlock()
+
+	store := NewRedisSessionStore()
+	store.SetOptions(SessionEngineOptions{
+		"address":  server.Addr().String(),
+		"password": "secret",
+	})
+	if _, err := store.pool.do("GET", "foo"); err == nil {
+		t.Fatal("First AUTH should fail")
+	}
+	if _, err := store.pool.do("GET", "foo"); err != nil {
+		t.Fatal("Connection should be authenticated, got", err)
+	}
+}
+
+// Test that several instances updating the same session don't lose values.
+func TestRedisSessionInstances(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	opts := SessionEngineOptions{"address": server.Addr().String()}
+	stores := []*RedisSessionStore{NewRedisSessionStore(), NewRedisSessionStore()}
+	for _, s := range stores {
+		s.SetOptions(opts)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := stores[i%2].update("shared", sessionValues{strconv.Itoa(i): "x"}); err != nil {
+				t.Error("Update failed", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	values, err := stores[0].load("shared", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if values[strconv.Itoa(i)] != "x" {
+			t.Fatal("Value", i, "is lost, got", values)
+		}
+	}
+}
+
+// Test that waiting for a pool connection is limited by the timeout.
+func TestRedisPoolTimeout(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	store := NewRedisSessionStore()
+	store.SetOptions(SessionEngineOptions{"address": server.Addr().String(), "poolsize": 1})
+	store.pool.timeout = 20 * time.Millisecond
+	c, err := store.pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.pool.do("GET", "foo"); err != ErrRedisPoolTimeout {
+		t.Fatal("Full pool should time out, got", err)
+	}
+	store.pool.release(c, nil)
+	if _, err := store.pool.do("GET", "foo"); err != nil {
+		t.Fatal("Released connection should be used, got", err)
+	}
+}
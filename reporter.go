@@ -0,0 +1,157 @@
+package kwiscale
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// redactedHeaders returns the request headers that are never sent to
+// reporters: credentials, API key headers and the CSRF header.
+func (app *App) redactedHeaders() []string {
+	headers := []string{"Authorization", "Cookie", "X-Admin-Token"}
+	for _, a := range app.authenticators {
+		if a, ok := a.(*APIKeyAuthenticator); ok && a.Header != "" {
+			headers = append(headers, a.Header)
+		}
+	}
+	if app.Config.CSRF != nil {
+		headers = append(headers, app.Config.CSRF.headerName())
+	}
+	return headers
+}
+
+// ErrorReport holds an error (or a panic) and the request metadata.
+type ErrorReport struct {
+	Time       time.Time
+	Status     int
+	Error      error
+	Details    []interface{}
+	Panic      interface{}
+	Stack      []byte
+	Route      string
+	Method     string
+	URL        string
+	RemoteAddr string
+	Header     http.Header
+}
+
+// ErrorReporter receives panics and 5xx errors. Register reporters with
+// App.AddErrorReporter().
+type ErrorReporter interface {
+	Report(*ErrorReport)
+}
+
+// AddErrorReporter appends a reporter that will receive panics and server
+// errors.
+func (app *App) AddErrorReporter(r ErrorReporter) {
+	app.reporters = append(app.reporters, r)
+}
+
+// report sends the report to every registered reporter. Request metadata
+// are taken from w if it was given by the framework.
+func (app *App) report(report *ErrorReport, w http.ResponseWriter) {
+	if len(app.reporters) == 0 {
+		return
+	}
+
+	report.Time = time.Now()
+	if rw := findResponseWriter(w); rw != nil && rw.request != nil {
+		report.Route = rw.route
+		report.Method = rw.request.Method
+		report.URL = rw.request.URL.String()
+		report.RemoteAddr = rw.request.RemoteAddr
+		report.Header = rw.request.Header.Clone()
+		for _, h := range app.redactedHeaders() {
+			if report.Header.Get(h) != "" {
+				report.Header.Set(h, "[redacted]")
+			}
+		}
+	}
+
+	for _, r := range app.reporters {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					Error("Error reporter panics", err)
+				}
+			}()
+			r.Report(report)
+		}()
+	}
+}
+
+// stack returns the current goroutine stack trace.
+func stack() []byte {
+	buf := make([]byte, 8192)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// WriterReporter writes reports as JSON lines to a writer.
+type WriterReporter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// NewWriterReporter returns a reporter that writes to w.
+func NewWriterReporter(w io.Writer) *WriterReporter {
+	return &WriterReporter{w: w}
+}
+
+// NewStdoutReporter returns a reporter that writes to STDOUT.
+func NewStdoutReporter() *WriterReporter {
+	return NewWriterReporter(os.Stdout)
+}
+
+// NewFileReporter returns a reporter that appends reports to the given file.
+func NewFileReporter(path string) (*WriterReporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterReporter(f), nil
+}
+
+// Report writes the report in JSON followed by a new line.
+func (r *WriterReporter) Report(report *ErrorReport) {
+	m := map[string]interface{}{
+		"time":   report.Time,
+		"status": report.Status,
+		"route":  report.Route,
+		"method": report.Method,
+		"url":    report.URL,
+		"remote": report.RemoteAddr,
+		"header": report.Header,
+	}
+	if report.Error != nil {
+		m["error"] = report.Error.Error()
+	}
+	if len(report.Details) > 0 {
+		m["details"] = fmt.Sprint(report.Details...)
+	}
+	if report.Panic != nil {
+		m["panic"] = fmt.Sprintf("%v", report.Panic)
+		m["stack"] = string(report.Stack)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		Error(err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.w.Write(append(b, '\n'))
+}
@@ -0,0 +1,109 @@
+package kwiscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A handler that panics.
+type panicHandler struct{ RequestHandler }
+
+func (h *panicHandler) Get() {
+	panic("boom")
+}
+
+// A handler that responds with a server error.
+type serverErrorHandler struct{ RequestHandler }
+
+func (h *serverErrorHandler) Get() {
+	h.Error(http.StatusBadGateway, "upstream is down")
+}
+
+// A reporter that keeps reports.
+type testReporter struct{ reports []*ErrorReport }
+
+func (r *testReporter) Report(report *ErrorReport) {
+	r.reports = append(r.reports, report)
+}
+
+// Test that panics are reported with stack trace, and that the stack is
+// not displayed without debug mode.
+func TestPanicReport(t *testing.T) {
+	app := initApp(t)
+	reporter := &testReporter{}
+	app.AddErrorReporter(reporter)
+	app.AddRoute("/panic", &panicHandler{})
+
+	r, _ := http.NewRequest("GET", "http://example.com/panic", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal("Panic should respond 500, got", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatal("Stack trace should not be displayed without debug mode")
+	}
+	if len(reporter.reports) != 1 {
+		t.Fatal("Panic should be reported once, got", len(reporter.reports))
+	}
+	report := reporter.reports[0]
+	if report.Panic != "boom" || len(report.Stack) == 0 || report.URL != "http://example.com/panic" {
+		t.Fatal("Bad report:", report)
+	}
+
+	SetDebug(true)
+	defer SetDebug(false)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatal("Stack trace should be displayed in debug mode")
+	}
+}
+
+// Test that server errors are written by WriterReporter.
+func TestWriterReporter(t *testing.T) {
+	app := initApp(t)
+	buf := &bytes.Buffer{}
+	app.AddErrorReporter(NewWriterReporter(buf))
+	app.AddRoute("/error", &serverErrorHandler{})
+
+	r, _ := http.NewRequest("GET", "http://example.com/error", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	app.ServeHTTP(httptest.NewRecorder(), r)
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal("Report is not a JSON line:", buf.String())
+	}
+	if m["error"] != "upstream is down" || m["status"] != float64(http.StatusBadGateway) {
+		t.Fatal("Bad report:", m)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatal("Authorization header should be redacted:", buf.String())
+	}
+}
+
+// Test that API key and CSRF headers are redacted.
+func TestReportRedactedHeaders(t *testing.T) {
+	app := NewApp(&Config{CSRF: &CSRFConfig{HeaderName: "X-Form-Token"}})
+	app.AddAuthenticator(&APIKeyAuthenticator{Header: "X-Api-Key"})
+	reporter := &testReporter{}
+	app.AddErrorReporter(reporter)
+	app.AddRoute("/error", &serverErrorHandler{})
+
+	w := serve(app, "/error", http.Header{"X-Api-Key": {"key"}, "X-Form-Token": {"token"}})
+	if len(reporter.reports) != 1 {
+		t.Fatal("Error should be reported, got", w.Code)
+	}
+	header := reporter.reports[0].Header
+	for _, h := range []string{"X-Api-Key", "X-Form-Token"} {
+		if header.Get(h) != "[redacted]" {
+			t.Errorf("%s should be redacted, got %q", h, header.Get(h))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package kwiscale
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CSPNonceSource is the placeholder to use in Content-Security-Policy sources. It
+// is replaced by the request nonce, eg. "'nonce-rAnd0m'".
+const CSPNonceSource = "'nonce'"
+
+// CSP is a Content-Security-Policy builder. Keys are directives and values
+// are sources. Use CSPNonceSource in sources to allow inline scripts or styles
+// that have the request nonce:
+//
+//	csp := kwiscale.CSP{}.
+//		Add("default-src", "'self'").
+//		Add("script-src", "'self'", kwiscale.CSPNonceSource)
+//
+// Then, in templates:
+//
+//	<script nonce="{{ .CSPNonce }}">...</script>
+type CSP map[string][]string
+
+// Add appends sources to directive and returns the CSP to chain calls.
+func (c CSP) Add(directive string, sources ...string) CSP {
+	c[directive] = append(c[directive], sources...)
+	return c
+}
+
+// hasNonce returns true if a directive uses the nonce.
+func (c CSP) hasNonce() bool {
+	for _, sources := range c {
+		for _, s := range sources {
+			if s == CSPNonceSource {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Build returns the policy header value, CSPNonceSource sources are replaced by
+// the given nonce. Directives are sorted to give a stable value.
+func (c CSP) Build(nonce string) string {
+	directives := make([]string, 0, len(c))
+	for d := range c {
+		directives = append(directives, d)
+	}
+	sort.Strings(directives)
+
+	policy := []string{}
+	for _, d := range directives {
+		parts := []string{d}
+		for _, s := range c[d] {
+			if s == CSPNonceSource {
+				s = "'nonce-" + nonce + "'"
+			}
+			parts = append(parts, s)
+		}
+		policy = append(policy, strings.Join(parts, " "))
+	}
+	return strings.Join(policy, "; ")
+}
+
+// SecurityConfig sets security headers on every responses, set it with
+// Config.Security. Empty values are not sent.
+type SecurityConfig struct {
+	// HSTSMaxAge is the Strict-Transport-Security max-age in seconds, only
+	// sent on HTTPS requests
+	HSTSMaxAge int `yaml:"hstsmaxage,omitempty"`
+	// HSTSIncludeSubdomains appends "includeSubDomains" to HSTS header
+	HSTSIncludeSubdomains bool `yaml:"hstssubdomains,omitempty"`
+	// HSTSPreload appends "preload" to HSTS header
+	HSTSPreload bool `yaml:"hstspreload,omitempty"`
+	// ContentTypeNosniff sends "X-Content-Type-Options: nosniff"
+	ContentTypeNosniff bool `yaml:"nosniff,omitempty"`
+	// FrameOptions is the X-Frame-Options value (DENY, SAMEORIGIN)
+	FrameOptions string `yaml:"frameoptions,omitempty"`
+	// ReferrerPolicy is the Referrer-Policy value
+	ReferrerPolicy string `yaml:"referrerpolicy,omitempty"`
+	// PermissionsPolicy is the Permissions-Policy value
+	PermissionsPolicy string `yaml:"permissionspolicy,omitempty"`
+	// CSP is the Content-Security-Policy
+	CSP CSP `yaml:"csp,omitempty"`
+	// CSPReportOnly sends CSP as Content-Security-Policy-Report-Only
+	CSPReportOnly bool `yaml:"cspreportonly,omitempty"`
+}
+
+// NewSecurityConfig returns a SecurityConfig with strict values: one year
+// HSTS, nosniff, frame denied, "strict-origin-when-cross-origin" referrer
+// and a CSP that only allows same origin resources and scripts or styles
+// that have the request nonce.
+func NewSecurityConfig() *SecurityConfig {
+	return &SecurityConfig{
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: true,
+		ContentTypeNosniff:    true,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		CSP: CSP{}.
+			Add("default-src", "'self'").
+			Add("script-src", "'self'", CSPNonceSource).
+			Add("style-src", "'self'", CSPNonceSource).
+			Add("object-src", "'none'").
+			Add("base-uri", "'self'").
+			Add("frame-ancestors", "'none'"),
+	}
+}
+
+// hsts returns the Strict-Transport-Security header value.
+func (c *SecurityConfig) hsts() string {
+	v := "max-age=" + strconv.Itoa(c.HSTSMaxAge)
+	if c.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if c.HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// isHTTPS returns true if the request was made with TLS, directly or
+// behind a proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// secureHeaders is the built-in middleware that writes security headers. If
+// the CSP uses a nonce, a new one is generated for each request.
+func (app *App) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := app.Config.Security
+		if c == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if c.HSTSMaxAge > 0 && isHTTPS(r) {
+			h.Set("Strict-Transport-Security", c.hsts())
+		}
+		if c.ContentTypeNosniff {
+			h.Set("X-Content-Type-Options", "nosniff")
+		}
+		if c.FrameOptions != "" {
+			h.Set("X-Frame-Options", c.FrameOptions)
+		}
+		if c.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", c.ReferrerPolicy)
+		}
+		if c.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", c.PermissionsPolicy)
+		}
+		if len(c.CSP) > 0 {
+			nonce := ""
+			if c.CSP.hasNonce() {
+				nonce = randomToken()
+				r = r.WithContext(context.WithValue(r.Context(), nonceContextKey, nonce))
+			}
+			header := "Content-Security-Policy"
+			if c.CSPReportOnly {
+				header += "-Report-Only"
+			}
+			h.Set(header, c.CSP.Build(nonce))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cspNonce returns the CSP nonce of the request, if any.
+func cspNonce(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	nonce, _ := r.Context().Value(nonceContextKey).(string)
+	return nonce
+}
+
+// CSPNonce returns the Content-Security-Policy nonce of the current request.
+// It is also given to templates as "CSPNonce" by RequestHandler.Render().
+func (b *BaseHandler) CSPNonce() string {
+	return cspNonce(b.request)
+}
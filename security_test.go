@@ -0,0 +1,59 @@
+package kwiscale
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A handler that renders an inline script.
+type nonceHandler struct{ RequestHandler }
+
+func (h *nonceHandler) Get() {
+	h.Render("script.html", nil)
+}
+
+// Test that security headers are sent and that the CSP nonce is given to
+// templates.
+func TestSecurityHeaders(t *testing.T) {
+	d, err := ioutil.TempDir("", "kwiscale-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	tpl := `<script nonce="{{ .CSPNonce }}"></script>`
+	if err := ioutil.WriteFile(filepath.Join(d, "script.html"), []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewApp(&Config{
+		TemplateDir: d,
+		Security:    NewSecurityConfig(),
+	})
+	app.AddRoute("/", &nonceHandler{})
+
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	h := w.Header()
+	if h.Get("X-Frame-Options") != "DENY" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatal("Security headers are not sent:", h)
+	}
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Fatal("HSTS should not be sent on plain HTTP")
+	}
+
+	body := w.Body.String()
+	nonce := strings.TrimSuffix(strings.TrimPrefix(body, `<script nonce="`), `"></script>`)
+	if nonce == "" || nonce == body {
+		t.Fatal("Nonce is not given to template:", body)
+	}
+	if !strings.Contains(h.Get("Content-Security-Policy"), "script-src 'self' 'nonce-"+nonce+"'") {
+		t.Fatal("CSP doesn't allow the template nonce:", h.Get("Content-Security-Policy"), nonce)
+	}
+}
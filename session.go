@@ -0,0 +1,305 @@
+package kwiscale
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ErrSessionReadOnly is returned when the session is changed after a
+// websocket upgrade, the cookie cannot be sent anymore.
+var ErrSessionReadOnly = errors.New("session is read only after websocket upgrade")
+
+// BatchSessionStore is an optional SessionStore interface for engines that
+// can read and write the whole session at once. Handler sessions are then
+// loaded once per request and saved once. Engines that only implement
+// SessionStore keep working, values are read and written one by one.
+type BatchSessionStore interface {
+	SessionStore
+
+	// Load returns every values of the session, nil if there is no session
+	Load(WebHandler) (map[interface{}]interface{}, error)
+
+	// Save records changed values, a nil value removes the key
+	Save(WebHandler, map[interface{}]interface{}) error
+}
+
+// Session holds the session values of a request. It is shared by
+// middlewares (CSRF, rate limits, authentication) and the handler. Values
+// are loaded on first access and changes are kept until Save() is called.
+// The framework saves the session before the response is written and when
+// the request ends, so handlers don't need to call it.
+type Session struct {
+	handler WebHandler
+	store   SessionStore
+	values  map[interface{}]interface{}
+	changes map[interface{}]interface{}
+	loaded  bool
+	// readOnly is the error returned on changes, set when the session is
+	// frozen or when the handler timed out
+	readOnly error
+	// a timed out handler may still use the session while it is saved
+	lock sync.Mutex
+}
+
+// newSession returns an unloaded session.
+func newSession(handler WebHandler, store SessionStore) *Session {
+	return &Session{
+		handler: handler,
+		store:   store,
+		values:  map[interface{}]interface{}{},
+		changes: map[interface{}]interface{}{},
+	}
+}
+
+// newRequestSession returns the session shared by middlewares and handler,
+// the store reads and writes cookies with w and r.
+func (app *App) newRequestSession(w http.ResponseWriter, r *http.Request) *Session {
+	b := &BaseHandler{}
+	b.setVars(nil, w, r)
+	b.setApp(app)
+	b.setSessionStore(app.sessionstore)
+	return newSession(b, app.sessionstore)
+}
+
+// requestSession returns the session of the request, or nil if the
+// request is not served by an App.
+func requestSession(r *http.Request) *Session {
+	if r == nil {
+		return nil
+	}
+	s, _ := r.Context().Value(sessionContextKey).(*Session)
+	return s
+}
+
+// load reads every values if the store can do it.
+func (s *Session) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	store, ok := s.store.(BatchSessionStore)
+	if !ok {
+		return
+	}
+	values, err := store.Load(s.handler)
+	if err != nil {
+		Log("Cannot load session", err)
+	}
+	for k, v := range values {
+		s.values[k] = v
+	}
+}
+
+// Get returns the value of key, or nil.
+func (s *Session) Get(key interface{}) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.changes[key]; ok {
+		return v
+	}
+	s.load()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	if _, ok := s.store.(BatchSessionStore); ok {
+		return nil
+	}
+	// engine reads values one by one
+	v, _ := s.store.Get(s.handler, key)
+	s.values[key] = v
+	return v
+}
+
+// stored returns true if values were loaded from the store, that is the
+// session cookie is valid. Engines that don't implement BatchSessionStore
+// only know the values that were read.
+func (s *Session) stored() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	for _, v := range s.values {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Set changes the value of key, a nil value removes the key.
+// ErrSessionReadOnly is returned after a websocket upgrade.
+func (s *Session) Set(key, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.readOnly != nil {
+		return s.readOnly
+	}
+	s.changes[key] = value
+	return nil
+}
+
+// Delete removes key from session.
+func (s *Session) Delete(key interface{}) error {
+	return s.Set(key, nil)
+}
+
+// freeze loads the session and refuses further changes, values are kept
+// as a snapshot. Changes must be saved before.
+func (s *Session) freeze() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	s.readOnly = ErrSessionReadOnly
+}
+
+// stop refuses further changes and saves, it is called when the handler
+// timed out: the response is already sent.
+func (s *Session) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readOnly = ErrTimeout
+}
+
+// bind makes the store read and write cookies with w, the writer given to
+// the handler.
+func (s *Session) bind(w http.ResponseWriter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b, ok := s.handler.(*BaseHandler); ok {
+		b.response = w
+	}
+}
+
+// clean removes the session from store, values and changes are lost.
+func (s *Session) clean() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.readOnly != nil {
+		return s.readOnly
+	}
+	s.store.Clean(s.handler)
+	s.values = map[interface{}]interface{}{}
+	s.changes = map[interface{}]interface{}{}
+	s.loaded = false
+	return nil
+}
+
+// regenerate gives a new session id, pending changes are saved later in
+// the new session.
+func (s *Session) regenerate() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.readOnly != nil {
+		return s.readOnly
+	}
+	store, ok := s.store.(SessionInvalidator)
+	if !ok {
+		return ErrSessionInvalidation
+	}
+	return store.Regenerate(s.handler)
+}
+
+// Keys returns the session keys. With engines that don't implement
+// BatchSessionStore, only keys that were read or set are known.
+func (s *Session) Keys() []interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	keys := []interface{}{}
+	for k, v := range s.values {
+		if _, changed := s.changes[k]; !changed && v != nil {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range s.changes {
+		if v != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Save records changes in the session store. With the cookie engine,
+// changes must be saved before the response is written to be kept.
+func (s *Session) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.changes) == 0 {
+		return nil
+	}
+	if s.readOnly == ErrTimeout {
+		return ErrTimeout
+	}
+	changes := s.changes
+	s.changes = map[interface{}]interface{}{}
+	for k, v := range changes {
+		s.values[k] = v
+	}
+
+	if store, ok := s.store.(BatchSessionStore); ok {
+		return store.Save(s.handler, changes)
+	}
+	for k, v := range changes {
+		s.store.Set(s.handler, k, v)
+	}
+	return nil
+}
+
+// saveOrLog saves the session and logs the error.
+func (s *Session) saveOrLog() {
+	if err := s.Save(); err != nil {
+		Error("Cannot save session", err)
+	}
+}
+
+// sessionWriter saves the request session before the response is started.
+type sessionWriter struct {
+	http.ResponseWriter
+	save    func()
+	started bool
+}
+
+// start saves the session once.
+func (sw *sessionWriter) start() {
+	if sw.started {
+		return
+	}
+	sw.started = true
+	sw.save()
+}
+
+// WriteHeader saves the session and sends status.
+func (sw *sessionWriter) WriteHeader(status int) {
+	sw.start()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write saves the session and sends data.
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	sw.start()
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (sw *sessionWriter) Flush() {
+	sw.start()
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, the session is saved before.
+func (sw *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.start()
+	if h, ok := sw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response writer cannot be hijacked")
+}
+
+// Unwrap returns the underlying writer.
+func (sw *sessionWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
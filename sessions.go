@@ -1,8 +1,15 @@
 package kwiscale
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
@@ -48,16 +55,123 @@ type SessionStore interface {
 	Clean(WebHandler)
 }
 
-// CookieSessionStore is a basic cookie based on gorilla.session.
+// ErrEmptySession is returned when a session value is not set.
+var ErrEmptySession = errors.New("empty session")
+
+// ErrSessionInvalidation is returned when the session engine cannot
+// invalidate sessions.
+var ErrSessionInvalidation = errors.New("session engine cannot invalidate sessions")
+
+// SessionInvalidator is an optional SessionStore interface for engines that
+// can change the session id and remove sessions of a user. Clean() must
+// remove the session, not only its values.
+type SessionInvalidator interface {
+	// Regenerate gives a new session id to client, values are kept
+	Regenerate(WebHandler) error
+
+	// InvalidateUser removes every sessions of a user, the user id is the
+	// one given at login (see BaseHandler.Login())
+	InvalidateUser(userID string) error
+}
+
+// session timestamps, recorded only if timeouts are set.
+const (
+	sessionCreatedKey = "_kwiscale_created"
+	sessionAccessKey  = "_kwiscale_access"
+)
+
+// newStamp returns a timestamp that every serializer keeps, JSON would
+// decode an integer as a float64.
+func newStamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// stampTime reads a timestamp given by newStamp. Integers written by
+// previous versions with gob are accepted.
+func stampTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(0, n), true
+	case int64:
+		return time.Unix(0, v), true
+	}
+	return time.Time{}, false
+}
+
+// sessionTimeouts are the idle and absolute timeouts of sessions.
+type sessionTimeouts struct {
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+// expired returns true if values are too old.
+func (t sessionTimeouts) expired(values map[interface{}]interface{}, now time.Time) bool {
+	if created, ok := stampTime(values[sessionCreatedKey]); ok && t.lifetime > 0 &&
+		now.Sub(created) > t.lifetime {
+		return true
+	}
+	if access, ok := stampTime(values[sessionAccessKey]); ok && t.idle > 0 &&
+		now.Sub(access) > t.idle {
+		return true
+	}
+	return false
+}
+
+// stamp records creation and access times.
+func (t sessionTimeouts) stamp(values map[interface{}]interface{}, now time.Time) {
+	if _, ok := values[sessionCreatedKey]; !ok && t.lifetime > 0 {
+		values[sessionCreatedKey] = newStamp(now)
+	}
+	if t.idle > 0 {
+		values[sessionAccessKey] = newStamp(now)
+	}
+}
+
+// CookieSessionStore is a basic cookie based on gorilla.session. Options
+// are cookie options (see cookieOptions), timeouts and keys:
+//
+//	ttl:        session lifetime since last access, eg. "30m" (default none)
+//	lifetime:   session lifetime since creation or regeneration (default none)
+//	serializer: "gob" (default), "json", "msgpack" or a registered serializer
+//	blockkey:   encryption key, cookie is only signed if it is not set
+//	oldkeys:    previous keys that are still accepted, a list of secrets or
+//	            of {hash: secret, block: blockkey}
+//
+// Block keys must be 16, 24 or 32 bytes long, other lengths are hashed to
+// get a 32 bytes key.
 type CookieSessionStore struct {
-	store  *sessions.CookieStore
-	name   string
-	secret []byte
+	store      *sessions.CookieStore
+	name       string
+	secret     []byte
+	options    *sessions.Options
+	keys       [][]byte
+	timeouts   sessionTimeouts
+	serializer SessionSerializer
 }
 
 // Init prepare the cookie storage.
 func (s *CookieSessionStore) Init() {
-	s.store = sessions.NewCookieStore(s.secret)
+	keys := [][]byte{s.secret}
+	if len(s.keys) > 0 {
+		keys = append(keys, s.keys[1:]...)
+	}
+	s.store = sessions.NewCookieStore(keys...)
+	if s.options != nil {
+		opts := *s.options
+		s.store.Options = &opts
+		s.store.MaxAge(opts.MaxAge)
+	}
+	if s.serializer != nil {
+		for _, codec := range s.store.Codecs {
+			if c, ok := codec.(*securecookie.SecureCookie); ok {
+				c.SetSerializer(s.serializer)
+			}
+		}
+	}
 }
 
 // SetSecret record a string to encode cookie
@@ -70,18 +184,119 @@ func (s *CookieSessionStore) Name(name string) {
 	s.name = name
 }
 
-// SetOptions does nothing for the engine
-func (*CookieSessionStore) SetOptions(SessionEngineOptions) {}
+// SetOptions reads cookie options and encryption keys.
+func (s *CookieSessionStore) SetOptions(opts SessionEngineOptions) {
+	s.options = cookieOptions(opts)
+	s.serializer = sessionSerializer(opts)
+	s.timeouts = sessionTimeouts{
+		idle:     optionDuration(opts, "ttl", 0),
+		lifetime: optionDuration(opts, "lifetime", 0),
+	}
+
+	// first pair is the current one, hash key is the session secret
+	s.keys = [][]byte{nil, blockKey(opts["blockkey"])}
+	if old, ok := opts["oldkeys"].([]interface{}); ok {
+		for _, k := range old {
+			switch k := k.(type) {
+			case string:
+				s.keys = append(s.keys, []byte(k), nil)
+			case map[interface{}]interface{}:
+				hash, _ := k["hash"].(string)
+				s.keys = append(s.keys, []byte(hash), blockKey(k["block"]))
+			case map[string]interface{}:
+				hash, _ := k["hash"].(string)
+				s.keys = append(s.keys, []byte(hash), blockKey(k["block"]))
+			}
+		}
+	}
+}
+
+// blockKey returns an AES key from option, or nil.
+func blockKey(v interface{}) []byte {
+	k, _ := v.(string)
+	switch len(k) {
+	case 0:
+		return nil
+	case 16, 24, 32:
+		return []byte(k)
+	}
+	h := sha256.Sum256([]byte(k))
+	return h[:]
+}
+
+// cookieOptions returns session cookie options from engine options:
+//
+//	maxage:   cookie lifetime in seconds or as duration ("720h"), default 30 days
+//	domain:   cookie domain
+//	path:     cookie path, default "/"
+//	secure:   send cookie only on HTTPS
+//	httponly: hide cookie from javascript, default true
+//	samesite: "lax" (default), "strict", "none" or "default"
+func cookieOptions(opts SessionEngineOptions) *sessions.Options {
+	o := &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(optionDuration(opts, "maxage", 30*24*time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if domain, ok := opts["domain"].(string); ok {
+		o.Domain = domain
+	}
+	if path, ok := opts["path"].(string); ok && path != "" {
+		o.Path = path
+	}
+	if secure, ok := opts["secure"].(bool); ok {
+		o.Secure = secure
+	}
+	if httpOnly, ok := opts["httponly"].(bool); ok {
+		o.HttpOnly = httpOnly
+	}
+	switch strings.ToLower(fmt.Sprint(opts["samesite"])) {
+	case "strict":
+		o.SameSite = http.SameSiteStrictMode
+	case "none":
+		o.SameSite = http.SameSiteNoneMode
+	case "default":
+		o.SameSite = http.SameSiteDefaultMode
+	}
+	return o
+}
+
+// session returns the request session, its values are removed if it timed
+// out. With an idle timeout, the access time is refreshed when a quarter of
+// the timeout is spent.
+func (s *CookieSessionStore) session(handler WebHandler) (*sessions.Session, error) {
+	session, err := s.store.Get(handler.getRequest(), s.name)
+	if err != nil || len(session.Values) == 0 {
+		return session, err
+	}
+	now := time.Now()
+	if s.timeouts.expired(session.Values, now) {
+		session.Values = make(map[interface{}]interface{})
+		return session, nil
+	}
+	if access, ok := stampTime(session.Values[sessionAccessKey]); ok && s.timeouts.idle > 0 &&
+		now.Sub(access) > s.timeouts.idle/4 {
+		s.save(handler, session)
+	}
+	return session, nil
+}
+
+// save stamps and writes the session cookie.
+func (s *CookieSessionStore) save(handler WebHandler, session *sessions.Session) error {
+	s.timeouts.stamp(session.Values, time.Now())
+	return causeError(session.Save(handler.getRequest(), handler.getResponse()))
+}
 
 // Get a value from session by name.
 func (s *CookieSessionStore) Get(handler WebHandler, key interface{}) (interface{}, error) {
-	session, err := s.store.Get(handler.getRequest(), s.name)
+	session, err := s.session(handler)
 	if err != nil {
 		return nil, err
 	}
 	Log("Getting session", key, session.Values[key])
 	if session.Values[key] == nil {
-		return nil, errors.New("empty session")
+		return nil, ErrEmptySession
 	}
 	return session.Values[key], nil
 }
@@ -89,14 +304,68 @@ func (s *CookieSessionStore) Get(handler WebHandler, key interface{}) (interface
 // Set a named value in sessionstore.
 func (s *CookieSessionStore) Set(handler WebHandler, key interface{}, val interface{}) {
 	Log("Writing session", key, val)
-	session, _ := s.store.Get(handler.getRequest(), s.name)
+	session, _ := s.session(handler)
 	session.Values[key] = val
-	session.Save(handler.getRequest(), handler.getResponse())
+	if err := s.save(handler, session); err != nil {
+		Error("Cannot save session", err)
+	}
 }
 
-// Clean removes the entire session values for current session.
+// Load returns every values of the session cookie.
+func (s *CookieSessionStore) Load(handler WebHandler) (map[interface{}]interface{}, error) {
+	session, err := s.session(handler)
+	if err != nil {
+		return nil, err
+	}
+	return session.Values, nil
+}
+
+// Save changes the session values and writes the cookie once.
+func (s *CookieSessionStore) Save(handler WebHandler, changes map[interface{}]interface{}) error {
+	session, _ := s.session(handler)
+	for k, v := range changes {
+		if v == nil {
+			delete(session.Values, k)
+			continue
+		}
+		session.Values[k] = v
+	}
+	return s.save(handler, session)
+}
+
+// Clean removes the session values and the cookie.
 func (s *CookieSessionStore) Clean(handler WebHandler) {
 	session, _ := s.store.Get(handler.getRequest(), s.name)
 	session.Values = make(map[interface{}]interface{})
-	session.Save(handler.getRequest(), handler.getResponse())
+	opts := *session.Options
+	opts.MaxAge = -1
+	http.SetCookie(handler.getResponse(), sessions.NewCookie(s.name, "", &opts))
+}
+
+// Regenerate resets the session creation time. Values are in the cookie,
+// so there is no id to change.
+func (s *CookieSessionStore) Regenerate(handler WebHandler) error {
+	if s.timeouts.lifetime == 0 {
+		return nil
+	}
+	session, _ := s.session(handler)
+	delete(session.Values, sessionCreatedKey)
+	return s.save(handler, session)
+}
+
+// InvalidateUser cannot remove cookies of other clients, it returns
+// ErrSessionInvalidation. Use a server side engine to do it.
+func (s *CookieSessionStore) InvalidateUser(string) error {
+	return ErrSessionInvalidation
+}
+
+// InvalidateAllSessions removes every sessions where the user is logged in,
+// eg. after a password change. The session engine must implement
+// SessionInvalidator, the cookie engine returns ErrSessionInvalidation.
+func (app *App) InvalidateAllSessions(userID string) error {
+	store, ok := app.sessionstore.(SessionInvalidator)
+	if !ok {
+		return ErrSessionInvalidation
+	}
+	return store.InvalidateUser(userID)
 }
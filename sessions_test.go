@@ -0,0 +1,151 @@
+package kwiscale
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cookieApp returns an app that uses the cookie session engine.
+func cookieApp(t *testing.T, secret string, opts SessionEngineOptions) *App {
+	app := NewApp(&Config{SessionSecret: []byte(secret), SessionEngineOptions: opts})
+	T[app] = t
+	app.AddRoute("/set/{key}/{value}", &sessionSetHandler{})
+	app.AddRoute("/get/{key}", &sessionGetHandler{})
+	return app
+}
+
+// A handler that changes several session values and lists the keys.
+type sessionBatchHandler struct{ RequestHandler }
+
+func (h *sessionBatchHandler) Get() {
+	session := h.Session()
+	session.Set("a", "1")
+	session.Set("b", "2")
+	session.Set("c", "3")
+	session.Delete(h.Vars["delete"])
+	keys := []string{}
+	for _, k := range session.Keys() {
+		keys = append(keys, k.(string))
+	}
+	sort.Strings(keys)
+	h.WriteString(fmt.Sprint(keys))
+}
+
+// Test that session changes are saved once.
+func TestSessionBatch(t *testing.T) {
+	for _, engine := range []string{"", "memory"} {
+		app := sessionApp(t, engine, nil)
+		app.AddRoute("/batch/{delete}", &sessionBatchHandler{})
+		w := serve(app, "/batch/b", nil)
+		if w.Body.String() != "[a c]" {
+			t.Fatal("Session keys are wrong, got", w.Body.String())
+		}
+		if len(w.Header()["Set-Cookie"]) != 1 {
+			t.Fatal("Session cookie should be written once, got", w.Header()["Set-Cookie"])
+		}
+		c := w.Result().Cookies()[0]
+		cookie := http.Header{"Cookie": {c.Name + "=" + c.Value}}
+		for key, value := range map[string]string{"a": "1", "b": "-", "c": "3"} {
+			if w := serve(app, "/get/"+key, cookie); w.Body.String() != value {
+				t.Fatalf("Session %s should be %s, got %s", key, value, w.Body.String())
+			}
+		}
+	}
+}
+
+// countingSessionStore counts session reads and writes.
+type countingSessionStore struct {
+	*MemorySessionStore
+	loads, saves atomic.Int32
+}
+
+func (s *countingSessionStore) Load(handler WebHandler) (map[interface{}]interface{}, error) {
+	s.loads.Add(1)
+	return s.MemorySessionStore.Load(handler)
+}
+
+func (s *countingSessionStore) Save(handler WebHandler, values map[interface{}]interface{}) error {
+	s.saves.Add(1)
+	return s.MemorySessionStore.Save(handler, values)
+}
+
+func (s *countingSessionStore) Get(handler WebHandler, key interface{}) (interface{}, error) {
+	s.loads.Add(1)
+	return s.MemorySessionStore.Get(handler, key)
+}
+
+func (s *countingSessionStore) Set(handler WebHandler, key, value interface{}) {
+	s.saves.Add(1)
+	s.MemorySessionStore.Set(handler, key, value)
+}
+
+// Test that middlewares and handler share the request session.
+func TestSessionShared(t *testing.T) {
+	store := &countingSessionStore{MemorySessionStore: NewMemorySessionStore()}
+	RegisterSessionEngine("counting", store)
+	app := NewApp(&Config{
+		SessionEngine: "counting",
+		CSRF:          &CSRFConfig{},
+		RateLimit:     &RateLimit{Requests: 10, Period: time.Minute, By: BySession},
+	})
+	T[app] = t
+	app.AddAuthenticator(NewSessionAuthenticator(nil))
+	app.AddRoute("/set/{key}/{value}", &sessionSetHandler{})
+
+	cookie := sessionCookie(t, serve(app, "/set/a/1", nil))
+	store.loads.Store(0)
+	store.saves.Store(0)
+	serve(app, "/set/b/2", cookie)
+	if store.loads.Load() != 1 || store.saves.Load() != 1 {
+		t.Fatal("Session should be loaded and saved once, got", store.loads.Load(), store.saves.Load())
+	}
+}
+
+// Test that cookie options are set on session cookie.
+func TestCookieSessionOptions(t *testing.T) {
+	app := cookieApp(t, "secret", SessionEngineOptions{
+		"domain":   "example.com",
+		"path":     "/app",
+		"secure":   true,
+		"samesite": "strict",
+		"maxage":   "1h",
+	})
+	w := serve(app, "/set/a/1", nil)
+	cookie := w.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Domain=example.com", "Path=/app", "Max-Age=3600", "HttpOnly", "Secure", "SameSite=Strict"} {
+		if !strings.Contains(cookie, attr) {
+			t.Errorf("Cookie should have %s: %s", attr, cookie)
+		}
+	}
+}
+
+// Test encrypted cookies and key rotation.
+func TestCookieSessionKeys(t *testing.T) {
+	app := cookieApp(t, "first secret", SessionEngineOptions{"blockkey": "first block key"})
+	c := serve(app, "/set/a/1", nil).Result().Cookies()[0]
+	cookie := http.Header{"Cookie": {c.Name + "=" + c.Value}}
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "1" {
+		t.Fatal("Encrypted session should be read, got", w.Body.String())
+	}
+
+	// the engine is shared, other apps replace its keys
+	app = cookieApp(t, "second secret", SessionEngineOptions{"blockkey": "second block key"})
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "-" {
+		t.Fatal("Session should not be read with other keys, got", w.Body.String())
+	}
+
+	app = cookieApp(t, "second secret", SessionEngineOptions{
+		"blockkey": "second block key",
+		"oldkeys": []interface{}{
+			map[interface{}]interface{}{"hash": "first secret", "block": "first block key"},
+		},
+	})
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "1" {
+		t.Fatal("Session should be read with old keys, got", w.Body.String())
+	}
+}
@@ -0,0 +1,241 @@
+package kwiscale
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gorilla/securecookie"
+)
+
+// sessionSerializers are the registered serializers. Built-in ones are set
+// here, not in init(), as session engines are registered in init() too.
+var sessionSerializers = map[string]SessionSerializer{
+	"gob":     GobSerializer{},
+	"json":    JSONSerializer{},
+	"msgpack": MsgpackSerializer{},
+}
+
+// SessionSerializer encodes session values. Serialize receives, and
+// Deserialize fills, a map[interface{}]interface{}. It is also a
+// securecookie.Serializer.
+type SessionSerializer interface {
+	Serialize(src interface{}) ([]byte, error)
+	Deserialize(src []byte, dst interface{}) error
+}
+
+// RegisterSessionSerializer records a serializer, session engines use it
+// when the "serializer" option is set to name.
+func RegisterSessionSerializer(name string, serializer SessionSerializer) {
+	sessionSerializers[name] = serializer
+}
+
+// sessionSerializer returns the serializer named by "serializer" option,
+// default is gob.
+func sessionSerializer(opts SessionEngineOptions) SessionSerializer {
+	name, _ := opts["serializer"].(string)
+	if name == "" {
+		name = "gob"
+	}
+	serializer, ok := sessionSerializers[name]
+	if !ok {
+		Error("Unknown session serializer", name, "gob is used")
+		return GobSerializer{}
+	}
+	return serializer
+}
+
+// SessionEncodingError is returned when session values cannot be encoded.
+// Key and Value are the first value that fails, if it is found.
+type SessionEncodingError struct {
+	Serializer string
+	Key        interface{}
+	Value      interface{}
+	Err        error
+}
+
+func (e *SessionEncodingError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("session: %s cannot encode values: %v", e.Serializer, e.Err)
+	}
+	return fmt.Sprintf("session: %s cannot encode %q value of type %T: %v", e.Serializer, fmt.Sprint(e.Key), e.Value, e.Err)
+}
+
+// Unwrap returns the serializer error.
+func (e *SessionEncodingError) Unwrap() error {
+	return e.Err
+}
+
+// encodingError finds the value that cannot be encoded.
+func encodingError(name string, values map[interface{}]interface{}, err error, encode func(map[interface{}]interface{}) error) error {
+	for k, v := range values {
+		if e := encode(map[interface{}]interface{}{k: v}); e != nil {
+			return &SessionEncodingError{Serializer: name, Key: k, Value: v, Err: e}
+		}
+	}
+	return &SessionEncodingError{Serializer: name, Err: err}
+}
+
+// causeError returns the SessionEncodingError wrapped by securecookie, or
+// err.
+func causeError(err error) error {
+	switch e := err.(type) {
+	case securecookie.MultiError:
+		if len(e) > 0 {
+			return causeError(e[0])
+		}
+	case interface{ Cause() error }:
+		if c, ok := e.Cause().(*SessionEncodingError); ok {
+			return c
+		}
+	}
+	return err
+}
+
+// sessionMap returns the values to encode.
+func sessionMap(src interface{}) (map[interface{}]interface{}, error) {
+	switch v := src.(type) {
+	case map[interface{}]interface{}:
+		return v, nil
+	case sessionValues:
+		return v, nil
+	}
+	return nil, fmt.Errorf("session: cannot serialize %T, values must be a map[interface{}]interface{}", src)
+}
+
+// setSessionMap sets the decoded values in dst.
+func setSessionMap(dst interface{}, values map[interface{}]interface{}) error {
+	switch d := dst.(type) {
+	case *map[interface{}]interface{}:
+		*d = values
+	case *sessionValues:
+		*d = values
+	default:
+		return fmt.Errorf("session: cannot deserialize in %T", dst)
+	}
+	return nil
+}
+
+// GobSerializer encodes session values with gob. Values keep their types,
+// but your own types must be given to gob.Register().
+type GobSerializer struct{}
+
+// Serialize encodes values with gob.
+func (GobSerializer) Serialize(src interface{}) ([]byte, error) {
+	values, err := sessionMap(src)
+	if err != nil {
+		return nil, err
+	}
+	encode := func(values map[interface{}]interface{}) error {
+		return gob.NewEncoder(&bytes.Buffer{}).Encode(values)
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(values); err != nil {
+		return nil, encodingError("gob", values, err, encode)
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decodes values with gob.
+func (GobSerializer) Deserialize(src []byte, dst interface{}) error {
+	values := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(src)).Decode(&values); err != nil {
+		return err
+	}
+	return setSessionMap(dst, values)
+}
+
+// JSONSerializer encodes session values with JSON. Keys must be strings,
+// values are decoded as JSON types (float64, string, bool, []interface{} and
+// map[string]interface{}), use SessionKey to get them with their type.
+type JSONSerializer struct{}
+
+// Serialize encodes values with JSON.
+func (JSONSerializer) Serialize(src interface{}) ([]byte, error) {
+	values, err := sessionMap(src)
+	if err != nil {
+		return nil, err
+	}
+	encode := func(values map[interface{}]interface{}) error {
+		_, err := jsonSessionMap(values)
+		return err
+	}
+	m, err := jsonSessionMap(values)
+	if err != nil {
+		return nil, encodingError("json", values, err, encode)
+	}
+	return m, nil
+}
+
+// jsonSessionMap encodes values with string keys.
+func jsonSessionMap(values map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("key of type %T is not a string", k)
+		}
+		m[key] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize decodes values with JSON.
+func (JSONSerializer) Deserialize(src []byte, dst interface{}) error {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(src, &m); err != nil {
+		return err
+	}
+	values := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return setSessionMap(dst, values)
+}
+
+// SessionKey is a session key that gives values of type T:
+//
+//	var cartKey = kwiscale.SessionKey[Cart]("cart")
+//
+//	cartKey.Set(h.Session(), cart)
+//	cart, err := cartKey.Get(h.Session())
+//
+// Serializers that don't keep types (json, msgpack) decode numbers and
+// structures as generic values, Get converts them back to T.
+type SessionKey[T any] string
+
+// Get returns the value of key, ErrEmptySession is returned if it is not
+// set.
+func (k SessionKey[T]) Get(s *Session) (T, error) {
+	var value T
+	v := s.Get(string(k))
+	if v == nil {
+		return value, ErrEmptySession
+	}
+	if value, ok := v.(T); ok {
+		return value, nil
+	}
+
+	// convert generic values through JSON
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(b, &value)
+	}
+	if err != nil {
+		return value, fmt.Errorf("session: %q value of type %T cannot be read as %s: %v",
+			string(k), v, reflect.TypeOf(&value).Elem(), err)
+	}
+	return value, nil
+}
+
+// Set changes the value of key.
+func (k SessionKey[T]) Set(s *Session, value T) error {
+	return s.Set(string(k), value)
+}
+
+// Delete removes key from session.
+func (k SessionKey[T]) Delete(s *Session) error {
+	return s.Delete(string(k))
+}
@@ -0,0 +1,247 @@
+package kwiscale
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a type that is not registered in gob
+type sessionCart struct {
+	Items []string
+	Total float64
+}
+
+var cartKey = SessionKey[sessionCart]("cart")
+
+// A handler that records a cart.
+type cartSetHandler struct{ RequestHandler }
+
+func (h *cartSetHandler) Get() {
+	cartKey.Set(h.Session(), sessionCart{Items: []string{"apple", "pear"}, Total: 4.5})
+	h.Session().Set("count", 2)
+	if err := h.Session().Save(); err != nil {
+		h.WriteString(err.Error())
+	}
+}
+
+// A handler that writes the cart.
+type cartGetHandler struct{ RequestHandler }
+
+func (h *cartGetHandler) Get() {
+	cart, err := cartKey.Get(h.Session())
+	if err != nil {
+		h.WriteString(err.Error())
+		return
+	}
+	count, err := SessionKey[int]("count").Get(h.Session())
+	if err != nil {
+		h.WriteString(err.Error())
+		return
+	}
+	h.WriteJSON(map[string]interface{}{"cart": cart, "count": count})
+}
+
+// Test typed values with every serializers.
+func TestSessionSerializers(t *testing.T) {
+	for _, serializer := range []string{"json", "msgpack"} {
+		for _, engine := range []string{"default", "file"} {
+			app := sessionApp(t, engine, SessionEngineOptions{"serializer": serializer, "dir": t.TempDir()})
+			app.AddRoute("/cart/set", &cartSetHandler{})
+			app.AddRoute("/cart/get", &cartGetHandler{})
+			w := serve(app, "/cart/set", nil)
+			if w.Body.String() != "" {
+				t.Fatal(engine, serializer, "cannot save session:", w.Body.String())
+			}
+			w = serve(app, "/cart/get", sessionCookie(t, w))
+			if w.Body.String() != `{"cart":{"Items":["apple","pear"],"Total":4.5},"count":2}` {
+				t.Fatal(engine, serializer, "values are not read back, got", w.Body.String())
+			}
+		}
+	}
+
+	// gob needs registered types
+	app := sessionApp(t, "file", SessionEngineOptions{"dir": t.TempDir()})
+	app.AddRoute("/cart/set", &cartSetHandler{})
+	w := serve(app, "/cart/set", nil)
+	want := `session: gob cannot encode "cart" value of type kwiscale.sessionCart: gob: type not registered for interface: kwiscale.sessionCart`
+	if w.Body.String() != want {
+		t.Fatal("Encoding error should be clear, got", w.Body.String())
+	}
+}
+
+// Test that timeouts are applied with every serializers.
+func TestSessionSerializerTimeouts(t *testing.T) {
+	for _, serializer := range []string{"gob", "json", "msgpack"} {
+		for _, engine := range []string{"default", "file"} {
+			for _, timeout := range []string{"ttl", "lifetime"} {
+				app := sessionApp(t, engine, SessionEngineOptions{
+					"serializer": serializer,
+					"dir":        t.TempDir(),
+					timeout:      "50ms",
+				})
+				cookie := sessionCookie(t, serve(app, "/set/a/1", nil))
+				if w := serve(app, "/get/a", cookie); w.Body.String() != "1" {
+					t.Fatal(engine, serializer, "session value is not kept, got", w.Body.String())
+				}
+				time.Sleep(100 * time.Millisecond)
+				if w := serve(app, "/get/a", cookie); w.Body.String() != "-" {
+					t.Fatal(engine, serializer, timeout, "session should be expired, got", w.Body.String())
+				}
+			}
+		}
+	}
+
+	// user index stamps
+	for name, serializer := range sessionSerializers {
+		b, err := serializer.Serialize(map[interface{}]interface{}{"id": newStamp(time.Now())})
+		values := map[interface{}]interface{}{}
+		if err == nil {
+			err = serializer.Deserialize(b, &values)
+		}
+		if _, ok := stampTime(values["id"]); err != nil || !ok {
+			t.Fatal(name, "stamp is not read back", values, err)
+		}
+	}
+}
+
+// Test encoding errors.
+func TestSessionEncodingError(t *testing.T) {
+	values := map[interface{}]interface{}{"ok": 1, "bad": func() {}}
+	for _, s := range []SessionSerializer{GobSerializer{}, JSONSerializer{}, MsgpackSerializer{}} {
+		_, err := s.Serialize(values)
+		var encErr *SessionEncodingError
+		if !errors.As(err, &encErr) || encErr.Key != "bad" {
+			t.Fatalf("%T should give the failing key, got %v", s, err)
+		}
+	}
+	if _, err := (JSONSerializer{}).Serialize(map[interface{}]interface{}{1: "a"}); err == nil {
+		t.Fatal("JSON keys must be strings")
+	}
+}
+
+// Test MessagePack encoding of basic types.
+func TestMsgpack(t *testing.T) {
+	long := string(make([]byte, 300))
+	values := map[interface{}]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  5,
+		"neg":    -100,
+		"big":    int64(1) << 40,
+		"uint":   uint64(1) << 63,
+		"float":  1.5,
+		"str":    "hello",
+		"long":   long,
+		"bytes":  []byte{1, 2, 3},
+		"list":   []string{"a", "b"},
+		"map":    map[string]int{"x": 1},
+		int64(7): "int key",
+	}
+	b, err := (MsgpackSerializer{}).Serialize(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[interface{}]interface{}{}
+	if err := (MsgpackSerializer{}).Deserialize(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[interface{}]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"small":  int64(5),
+		"neg":    int64(-100),
+		"big":    int64(1) << 40,
+		"uint":   uint64(1) << 63,
+		"float":  1.5,
+		"str":    "hello",
+		"long":   long,
+		"bytes":  []byte{1, 2, 3},
+		"list":   []interface{}{"a", "b"},
+		"map":    map[string]interface{}{"x": int64(1)},
+		int64(7): "int key",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Values are not decoded, got %#v", got)
+	}
+}
+
+// named types for msgpack tests
+type (
+	namedBool   bool
+	namedInt    int16
+	namedUint   uint8
+	namedFloat  float32
+	namedString string
+	namedBytes  []byte
+	namedList   []namedString
+	namedDict   map[namedString]namedInt
+)
+
+// Test that named types are read back with SessionKey.
+func TestMsgpackNamedTypes(t *testing.T) {
+	cart := &sessionCart{Items: []string{"apple"}, Total: 1.5}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	values := map[interface{}]interface{}{
+		"bool":   namedBool(true),
+		"int":    namedInt(-300),
+		"uint":   namedUint(200),
+		"float":  namedFloat(2.5),
+		"string": namedString("hello"),
+		"bytes":  namedBytes("\x00\xffdata"),
+		"array":  [2]byte{1, 2},
+		"list":   namedList{"a", "b"},
+		"dict":   namedDict{"a": 1},
+		"ptr":    cart,
+		"time":   now,
+	}
+	b, err := MsgpackSerializer{}.Serialize(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[interface{}]interface{}{}
+	if err := (MsgpackSerializer{}).Deserialize(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded["bytes"].([]byte); !ok {
+		t.Fatalf("Named byte slice should be binary, got %T", decoded["bytes"])
+	}
+
+	s := newSession(nil, nil)
+	s.values = decoded
+	s.loaded = true
+	check := func(name string, got, want interface{}, err error) {
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s should be read back as %#v, got %#v (%v)", name, want, got, err)
+		}
+	}
+	vBool, err := SessionKey[namedBool]("bool").Get(s)
+	check("bool", vBool, values["bool"], err)
+	vInt, err := SessionKey[namedInt]("int").Get(s)
+	check("int", vInt, values["int"], err)
+	vUint, err := SessionKey[namedUint]("uint").Get(s)
+	check("uint", vUint, values["uint"], err)
+	vFloat, err := SessionKey[namedFloat]("float").Get(s)
+	check("float", vFloat, values["float"], err)
+	vString, err := SessionKey[namedString]("string").Get(s)
+	check("string", vString, values["string"], err)
+	vBytes, err := SessionKey[namedBytes]("bytes").Get(s)
+	check("bytes", vBytes, values["bytes"], err)
+	vArray, err := SessionKey[[2]byte]("array").Get(s)
+	check("array", vArray, values["array"], err)
+	vList, err := SessionKey[namedList]("list").Get(s)
+	check("list", vList, values["list"], err)
+	vDict, err := SessionKey[namedDict]("dict").Get(s)
+	check("dict", vDict, values["dict"], err)
+	vPtr, err := SessionKey[*sessionCart]("ptr").Get(s)
+	check("ptr", vPtr, values["ptr"], err)
+	vTime, err := SessionKey[time.Time]("time").Get(s)
+	check("time", vTime, values["time"], err)
+
+	for _, v := range []interface{}{complex(1, 2), make(chan int)} {
+		if _, err := (MsgpackSerializer{}).Serialize(map[interface{}]interface{}{"v": v}); err == nil {
+			t.Errorf("%T should be refused", v)
+		}
+	}
+}
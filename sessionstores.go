@@ -0,0 +1,651 @@
+package kwiscale
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// default server side session settings.
+const (
+	defaultSessionTTL        = 24 * time.Hour
+	defaultSessionGCInterval = 10 * time.Minute
+)
+
+// Register server side session engines.
+func init() {
+	RegisterSessionEngine("memory", NewMemorySessionStore())
+	RegisterSessionEngine("file", NewFileSessionStore())
+}
+
+// sessionValues are the values of a session.
+type sessionValues map[interface{}]interface{}
+
+// sessionBackend keeps session values for a serverSessionStore. Methods
+// are called with the session lock held, except gc.
+type sessionBackend interface {
+	// load returns values, or nil if session doesn't exist or is expired
+	load(id string, ttl time.Duration) (sessionValues, error)
+	save(id string, values sessionValues) error
+	delete(id string) error
+	// gc removes expired sessions
+	gc(ttl time.Duration)
+}
+
+// transactionBackend is implemented by backends shared by several
+// instances, the session lock doesn't protect them. apply is given the
+// stored values (nil if the session doesn't exist) and its result is saved
+// atomically, it is called again if the session changed meanwhile.
+type transactionBackend interface {
+	transaction(id string, ttl time.Duration, apply func(sessionValues) sessionValues) error
+}
+
+// serverSessionStore keeps session values on server side, the cookie only
+// holds a signed session id. Options are:
+//
+//	ttl:        session lifetime since last access, eg. "30m" (default "24h")
+//	lifetime:   session lifetime since creation or regeneration (default none)
+//	gcinterval: delay between expired sessions removal (default "10m")
+//	serializer: "gob" (default), "json", "msgpack" or a registered
+//	            serializer, for engines that encode values
+//
+// Cookie options are also read (see cookieOptions), maxage defaults to ttl.
+type serverSessionStore struct {
+	name       string
+	secret     []byte
+	ttl        time.Duration
+	lifetime   time.Duration
+	gcInterval time.Duration
+	cookie     *sessions.Options
+	serializer SessionSerializer
+	backend    sessionBackend
+
+	// locks serialize read-modify-write on a session, by id hash
+	locks [64]sync.Mutex
+	// touched keeps the last indexing time of sessions
+	touched sync.Map
+	stop    chan struct{}
+	mu      sync.Mutex
+}
+
+// Name sets the cookie name.
+func (s *serverSessionStore) Name(name string) {
+	s.name = name
+}
+
+// SetSecret sets the key that signs session ids.
+func (s *serverSessionStore) SetSecret(secret []byte) {
+	s.secret = secret
+}
+
+// setOptions reads common options.
+func (s *serverSessionStore) setOptions(opts SessionEngineOptions) {
+	s.ttl = optionDuration(opts, "ttl", defaultSessionTTL)
+	s.lifetime = optionDuration(opts, "lifetime", 0)
+	s.gcInterval = optionDuration(opts, "gcinterval", defaultSessionGCInterval)
+	s.cookie = cookieOptions(opts)
+	s.serializer = sessionSerializer(opts)
+	if _, ok := opts["maxage"]; !ok {
+		s.cookie.MaxAge = int(s.ttl.Seconds())
+	}
+}
+
+// Init starts the garbage collector. If the store was already initialized,
+// the previous collector is stopped.
+func (s *serverSessionStore) Init() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.stop = make(chan struct{})
+	go s.collect(s.stop, s.gcInterval, s.ttl)
+}
+
+// collect removes expired sessions every interval, until stop is closed.
+func (s *serverSessionStore) collect(stop chan struct{}, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.backend.gc(ttl)
+			s.touched.Range(func(id, t interface{}) bool {
+				if time.Since(t.(time.Time)) > ttl {
+					s.touched.Delete(id)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// encode serializes values for backends that store bytes.
+func (s *serverSessionStore) encode(values sessionValues) ([]byte, error) {
+	return s.serializer.Serialize(values)
+}
+
+// decode deserializes values.
+func (s *serverSessionStore) decode(b []byte) (sessionValues, error) {
+	values := sessionValues{}
+	if err := s.serializer.Deserialize(b, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// lock returns the lock of a session.
+func (s *serverSessionStore) lock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+// sign returns the cookie value for id.
+func (s *serverSessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session id of a cookie value, or an empty string if
+// the signature is not valid.
+func (s *serverSessionStore) verify(value string) string {
+	i := strings.LastIndex(value, ".")
+	if i <= 0 {
+		return ""
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(s.sign(id)), []byte(value)) {
+		return ""
+	}
+	return id
+}
+
+// sessionID returns the session id of the request. If create is true and
+// there is no session, a new id is given to client.
+func (s *serverSessionStore) sessionID(handler WebHandler, create bool) string {
+	id := ""
+
+	// a session created or removed earlier in this request replaces the
+	// client one
+	w := handler.getResponse()
+	resp := &http.Response{Header: http.Header{"Set-Cookie": w.Header()["Set-Cookie"]}}
+	found := false
+	for _, c := range resp.Cookies() {
+		if c.Name == s.name {
+			found = true
+			id = s.verify(c.Value)
+		}
+	}
+	if !found {
+		if c, err := handler.getRequest().Cookie(s.name); err == nil {
+			id = s.verify(c.Value)
+		}
+	}
+
+	if id != "" || !create {
+		return id
+	}
+	return s.newID(handler)
+}
+
+// newID gives a new session id to client.
+func (s *serverSessionStore) newID(handler WebHandler) string {
+	id := randomToken()
+	http.SetCookie(handler.getResponse(), sessions.NewCookie(s.name, s.sign(id), s.cookie))
+	return id
+}
+
+// timeouts returns the timeouts checked on values, idle timeout is handled
+// by backend.
+func (s *serverSessionStore) timeouts() sessionTimeouts {
+	return sessionTimeouts{lifetime: s.lifetime}
+}
+
+// load returns the session values, an expired session is removed. Session
+// lock must be held.
+func (s *serverSessionStore) load(id string) (sessionValues, error) {
+	values, err := s.backend.load(id, s.ttl)
+	if err != nil || values == nil {
+		return nil, err
+	}
+	if s.timeouts().expired(values, time.Now()) {
+		return nil, s.backend.delete(id)
+	}
+	return values, nil
+}
+
+// modify saves the values returned by apply, it is given the stored values
+// or nil. Session lock must be held.
+func (s *serverSessionStore) modify(id string, apply func(sessionValues) sessionValues) error {
+	if b, ok := s.backend.(transactionBackend); ok {
+		return b.transaction(id, s.ttl, apply)
+	}
+	values, err := s.backend.load(id, s.ttl)
+	if err != nil {
+		values = nil
+	}
+	return s.backend.save(id, apply(values))
+}
+
+// update applies changes on session values, a nil value removes the key.
+// The session is locked while it is read and written, so concurrent
+// requests don't lose values. Backends shared by several instances update
+// values in a transaction.
+func (s *serverSessionStore) update(id string, changes sessionValues) error {
+	var values sessionValues
+	l := s.lock(id)
+	l.Lock()
+	err := s.modify(id, func(stored sessionValues) sessionValues {
+		now := time.Now()
+		values = sessionValues{}
+		if stored != nil && !s.timeouts().expired(stored, now) {
+			for k, v := range stored {
+				values[k] = v
+			}
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(values, k)
+				continue
+			}
+			values[k] = v
+		}
+		s.timeouts().stamp(values, now)
+		return values
+	})
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.index(values, id)
+}
+
+// Get returns a session value.
+func (s *serverSessionStore) Get(handler WebHandler, key interface{}) (interface{}, error) {
+	id := s.sessionID(handler, false)
+	if id == "" {
+		return nil, ErrEmptySession
+	}
+	l := s.lock(id)
+	l.Lock()
+	values, err := s.load(id)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.keepIndex(values, id)
+	if values[key] == nil {
+		return nil, ErrEmptySession
+	}
+	return values[key], nil
+}
+
+// Set records a session value.
+func (s *serverSessionStore) Set(handler WebHandler, key interface{}, val interface{}) {
+	id := s.sessionID(handler, true)
+	if err := s.update(id, sessionValues{key: val}); err != nil {
+		Error("Cannot save session", err)
+	}
+}
+
+// Load returns every values of the session.
+func (s *serverSessionStore) Load(handler WebHandler) (map[interface{}]interface{}, error) {
+	id := s.sessionID(handler, false)
+	if id == "" {
+		return nil, nil
+	}
+	l := s.lock(id)
+	l.Lock()
+	values, err := s.load(id)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.keepIndex(values, id)
+	return values, nil
+}
+
+// Save applies changes on the stored values.
+func (s *serverSessionStore) Save(handler WebHandler, changes map[interface{}]interface{}) error {
+	return s.update(s.sessionID(handler, true), changes)
+}
+
+// Clean removes the session and the client cookie.
+func (s *serverSessionStore) Clean(handler WebHandler) {
+	id := s.sessionID(handler, false)
+	if id == "" {
+		return
+	}
+	opts := *s.cookie
+	opts.MaxAge = -1
+	http.SetCookie(handler.getResponse(), sessions.NewCookie(s.name, "", &opts))
+
+	l := s.lock(id)
+	l.Lock()
+	defer l.Unlock()
+	if err := s.backend.delete(id); err != nil {
+		Error("Cannot remove session", err)
+	}
+}
+
+// Regenerate moves the session values to a new id, the old session is
+// removed.
+func (s *serverSessionStore) Regenerate(handler WebHandler) error {
+	values := sessionValues{}
+	if old := s.sessionID(handler, false); old != "" {
+		l := s.lock(old)
+		l.Lock()
+		v, err := s.load(old)
+		if err == nil {
+			err = s.backend.delete(old)
+		}
+		l.Unlock()
+		if err != nil {
+			return err
+		}
+		for k, val := range v {
+			values[k] = val
+		}
+	}
+	delete(values, sessionCreatedKey)
+	return s.update(s.newID(handler), values)
+}
+
+// userIndexID returns the id of the session that lists the sessions of a
+// user. It cannot be given by clients, ids are signed.
+func userIndexID(userID string) string {
+	h := sha256.Sum256([]byte(userID))
+	return "user-" + hex.EncodeToString(h[:])
+}
+
+// index records the session id in the sessions list of its user. Ids are
+// kept with the indexing time, ids that are not indexed again during ttl
+// belong to expired sessions and are removed.
+func (s *serverSessionStore) index(values sessionValues, id string) error {
+	userID, _ := values[userSessionKey].(string)
+	if userID == "" {
+		return nil
+	}
+	index := userIndexID(userID)
+	l := s.lock(index)
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	s.touched.Store(id, now)
+	return s.modify(index, func(stored sessionValues) sessionValues {
+		ids := sessionValues{}
+		for k, v := range stored {
+			if t, ok := stampTime(v); ok && now.Sub(t) <= s.ttl {
+				ids[k] = v
+			}
+		}
+		ids[id] = newStamp(now)
+		return ids
+	})
+}
+
+// keepIndex indexes the session again before its index entry is pruned, a
+// session may be read without being saved.
+func (s *serverSessionStore) keepIndex(values sessionValues, id string) {
+	userID, _ := values[userSessionKey].(string)
+	if userID == "" {
+		return
+	}
+	if t, ok := s.touched.Load(id); ok && time.Since(t.(time.Time)) < s.ttl/4 {
+		return
+	}
+	if err := s.index(values, id); err != nil {
+		Error("Cannot index session", err)
+	}
+}
+
+// InvalidateUser removes every sessions where the user is logged in.
+func (s *serverSessionStore) InvalidateUser(userID string) error {
+	index := userIndexID(userID)
+	l := s.lock(index)
+	l.Lock()
+	ids, err := s.backend.load(index, s.ttl)
+	if err == nil {
+		err = s.backend.delete(index)
+	}
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for id := range ids {
+		id, _ := id.(string)
+		l := s.lock(id)
+		l.Lock()
+		values, err := s.backend.load(id, s.ttl)
+		if err == nil && values[userSessionKey] == userID {
+			err = s.backend.delete(id)
+		}
+		l.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemorySessionStore keeps sessions in memory, they are lost when the
+// process stops. It is registered as "memory" session engine. Values are
+// not encoded, the "serializer" option is ignored.
+type MemorySessionStore struct {
+	serverSessionStore
+	sessions sync.Map
+}
+
+// memorySession is a session kept in memory.
+type memorySession struct {
+	values     sessionValues
+	lastAccess time.Time
+}
+
+// NewMemorySessionStore returns an empty memory session store.
+func NewMemorySessionStore() *MemorySessionStore {
+	s := &MemorySessionStore{}
+	s.backend = s
+	s.setOptions(nil)
+	return s
+}
+
+// SetOptions reads "ttl" and "gcinterval" options.
+func (s *MemorySessionStore) SetOptions(opts SessionEngineOptions) {
+	s.setOptions(opts)
+}
+
+func (s *MemorySessionStore) load(id string, ttl time.Duration) (sessionValues, error) {
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		return nil, nil
+	}
+	session := v.(*memorySession)
+	if time.Since(session.lastAccess) > ttl {
+		s.sessions.Delete(id)
+		return nil, nil
+	}
+	session.lastAccess = time.Now()
+	// give a copy, values are changed only by save
+	values := sessionValues{}
+	for k, v := range session.values {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (s *MemorySessionStore) save(id string, values sessionValues) error {
+	s.sessions.Store(id, &memorySession{values: values, lastAccess: time.Now()})
+	return nil
+}
+
+func (s *MemorySessionStore) delete(id string) error {
+	s.sessions.Delete(id)
+	return nil
+}
+
+func (s *MemorySessionStore) gc(ttl time.Duration) {
+	s.sessions.Range(func(id, v interface{}) bool {
+		l := s.lock(id.(string))
+		l.Lock()
+		if time.Since(v.(*memorySession).lastAccess) > ttl {
+			s.sessions.Delete(id)
+		}
+		l.Unlock()
+		return true
+	})
+}
+
+// FileSessionStore keeps sessions in files, one file per session. It is
+// registered as "file" session engine. Values are encoded with the
+// "serializer" option, gob by default (use gob.Register() for your own
+// types). Set the "dir" option to choose the directory, default is
+// "kwiscale-sessions" in the temporary directory.
+type FileSessionStore struct {
+	serverSessionStore
+	dir string
+}
+
+// NewFileSessionStore returns a file session store.
+func NewFileSessionStore() *FileSessionStore {
+	s := &FileSessionStore{}
+	s.backend = s
+	s.setOptions(nil)
+	s.dir = filepath.Join(os.TempDir(), "kwiscale-sessions")
+	return s
+}
+
+// SetOptions reads "dir", "ttl" and "gcinterval" options.
+func (s *FileSessionStore) SetOptions(opts SessionEngineOptions) {
+	s.setOptions(opts)
+	if dir, ok := opts["dir"].(string); ok && dir != "" {
+		s.dir = dir
+	}
+}
+
+// Init creates the session directory and starts the garbage collector.
+func (s *FileSessionStore) Init() {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		Error("Cannot create session directory", s.dir, err)
+	}
+	s.serverSessionStore.Init()
+}
+
+// path returns the file of a session, id is checked by signature so it
+// cannot hold a path separator.
+func (s *FileSessionStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".session")
+}
+
+func (s *FileSessionStore) load(id string, ttl time.Duration) (sessionValues, error) {
+	path := s.path(id)
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(stat.ModTime()) > ttl {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.decode(content)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return values, nil
+}
+
+func (s *FileSessionStore) save(id string, values sessionValues) error {
+	content, err := s.encode(values)
+	if err != nil {
+		return err
+	}
+	// write in a temporary file then rename, readers never see partial data
+	tmp := s.path(id) + "." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(id))
+}
+
+func (s *FileSessionStore) delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileSessionStore) gc(ttl time.Duration) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.session"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".session")
+		l := s.lock(id)
+		l.Lock()
+		if stat, err := os.Stat(f); err == nil && time.Since(stat.ModTime()) > ttl {
+			os.Remove(f)
+		}
+		l.Unlock()
+	}
+}
+
+// optionDuration reads a duration option, given as a duration string
+// ("30m") or as a number of seconds.
+func optionDuration(opts SessionEngineOptions, key string, def time.Duration) time.Duration {
+	switch v := opts[key].(type) {
+	case time.Duration:
+		return v
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	case int:
+		return time.Duration(v) * time.Second
+	case float64:
+		return time.Duration(v * float64(time.Second))
+	}
+	return def
+}
+
+// optionInt reads an integer option.
+func optionInt(opts SessionEngineOptions, key string, def int) int {
+	switch v := opts[key].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
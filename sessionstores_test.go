@@ -0,0 +1,189 @@
+package kwiscale
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A handler that sets the session "key" to "value".
+type sessionSetHandler struct{ RequestHandler }
+
+func (h *sessionSetHandler) Get() {
+	h.SetSession(h.Vars["key"], h.Vars["value"])
+}
+
+// A handler that writes the session "key".
+type sessionGetHandler struct{ RequestHandler }
+
+func (h *sessionGetHandler) Get() {
+	v, err := h.GetSession(h.Vars["key"])
+	if err != nil {
+		h.WriteString("-")
+		return
+	}
+	h.WriteString(v.(string))
+}
+
+// A handler that removes the session.
+type sessionCleanHandler struct{ RequestHandler }
+
+func (h *sessionCleanHandler) Get() {
+	h.CleanSession()
+}
+
+// sessionApp returns an app that uses the session engine.
+func sessionApp(t *testing.T, engine string, opts SessionEngineOptions) *App {
+	app := NewApp(&Config{SessionEngine: engine, SessionEngineOptions: opts})
+	T[app] = t
+	app.AddRoute("/set/{key}/{value}", &sessionSetHandler{})
+	app.AddRoute("/get/{key}", &sessionGetHandler{})
+	app.AddRoute("/clean", &sessionCleanHandler{})
+	app.AddRoute("/login/{login}", &loginHandler{})
+	return app
+}
+
+// sessionCookie returns the last session cookie of a response, as request
+// header.
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) http.Header {
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Session cookie is not set")
+	}
+	c := cookies[len(cookies)-1]
+	return http.Header{"Cookie": {c.Name + "=" + c.Value}}
+}
+
+// testSessionEngine checks values are kept, and that concurrent writes on
+// the same session are not lost.
+func testSessionEngine(t *testing.T, app *App) {
+	w := serve(app, "/set/a/1", nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("Session cookie should be set once, got", w.Header()["Set-Cookie"])
+	}
+	cookie := http.Header{"Cookie": {cookies[0].Name + "=" + cookies[0].Value}}
+
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "1" {
+		t.Fatal("Session value is not kept, got", w.Body.String())
+	}
+	if w := serve(app, "/get/a", nil); w.Body.String() != "-" {
+		t.Fatal("Other clients should not see the session, got", w.Body.String())
+	}
+	forged := http.Header{"Cookie": {cookies[0].Name + "=" + cookies[0].Value + "x"}}
+	if w := serve(app, "/get/a", forged); w.Body.String() != "-" {
+		t.Fatal("Forged session id should be refused, got", w.Body.String())
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serve(app, fmt.Sprintf("/set/k%d/%d", i, i), cookie)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if w := serve(app, fmt.Sprintf("/get/k%d", i), cookie); w.Body.String() != fmt.Sprint(i) {
+			t.Fatalf("Concurrent write k%d is lost, got %s", i, w.Body.String())
+		}
+	}
+}
+
+// Test the memory session engine.
+func TestMemorySession(t *testing.T) {
+	testSessionEngine(t, sessionApp(t, "memory", nil))
+}
+
+// Test the file session engine and expiry.
+func TestFileSession(t *testing.T) {
+	dir := t.TempDir()
+	app := sessionApp(t, "file", SessionEngineOptions{"dir": dir, "ttl": "1h"})
+	testSessionEngine(t, app)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.session"))
+	if len(files) != 1 {
+		t.Fatal("One session file should be written, got", files)
+	}
+
+	// expire the session
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(files[0], old, old)
+	app.sessionstore.(*FileSessionStore).gc(time.Hour)
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Fatal("Expired session should be removed")
+	}
+}
+
+// Test that login gives a new session id and keeps values.
+func TestSessionRegenerate(t *testing.T) {
+	app := sessionApp(t, "memory", nil)
+	old := sessionCookie(t, serve(app, "/set/a/1", nil))
+	login := sessionCookie(t, serve(app, "/login/dave", old))
+	if login.Get("Cookie") == old.Get("Cookie") {
+		t.Fatal("Session id should change on login")
+	}
+	if w := serve(app, "/get/a", login); w.Body.String() != "1" {
+		t.Fatal("Values should be kept in new session, got", w.Body.String())
+	}
+	if w := serve(app, "/get/a", old); w.Body.String() != "-" {
+		t.Fatal("Old session should be removed, got", w.Body.String())
+	}
+}
+
+// Test that cleaning a session removes it and the client cookie.
+func TestSessionClean(t *testing.T) {
+	app := sessionApp(t, "memory", nil)
+	cookie := sessionCookie(t, serve(app, "/set/a/1", nil))
+	w := serve(app, "/clean", cookie)
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Fatal("Session cookie should be removed, got", w.Header()["Set-Cookie"])
+	}
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "-" {
+		t.Fatal("Session should be removed, got", w.Body.String())
+	}
+}
+
+// Test the absolute session timeout.
+func TestSessionLifetime(t *testing.T) {
+	app := sessionApp(t, "memory", SessionEngineOptions{"lifetime": "50ms"})
+	cookie := sessionCookie(t, serve(app, "/set/a/1", nil))
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "1" {
+		t.Fatal("Session value is not kept, got", w.Body.String())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if w := serve(app, "/get/a", cookie); w.Body.String() != "-" {
+		t.Fatal("Session should be expired, got", w.Body.String())
+	}
+}
+
+// Test that every sessions of a user are removed.
+func TestInvalidateAllSessions(t *testing.T) {
+	app := sessionApp(t, "memory", nil)
+	first := sessionCookie(t, serve(app, "/login/dave", nil))
+	second := sessionCookie(t, serve(app, "/login/dave", nil))
+	other := sessionCookie(t, serve(app, "/login/alice", nil))
+
+	if err := app.InvalidateAllSessions("dave"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range []http.Header{first, second} {
+		if w := serve(app, "/get/"+userSessionKey, cookie); w.Body.String() != "-" {
+			t.Fatal("Session should be removed, got", w.Body.String())
+		}
+	}
+	if w := serve(app, "/get/"+userSessionKey, other); w.Body.String() != "alice" {
+		t.Fatal("Other user session should be kept, got", w.Body.String())
+	}
+
+	app = sessionApp(t, "default", nil)
+	if err := app.InvalidateAllSessions("dave"); err != ErrSessionInvalidation {
+		t.Fatal("Cookie sessions cannot be invalidated, got", err)
+	}
+}
@@ -0,0 +1,141 @@
+package kwiscale
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// query parameters of signed URLs.
+const (
+	signatureParam = "signature"
+	expiresParam   = "expires"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed URL is altered or
+	// not signed.
+	ErrInvalidSignature = errors.New("Invalid URL signature")
+	// ErrURLExpired is returned when a signed URL is expired.
+	ErrURLExpired = errors.New("URL expired")
+	// ErrNoSigningKey is returned when URLs are signed without
+	// Config.URLSigningKeys nor Config.SessionSecret.
+	ErrNoSigningKey = errors.New("URL signing needs Config.URLSigningKeys or Config.SessionSecret")
+)
+
+// signingKeys returns keys to sign and verify URLs, the first one signs.
+// If Config.URLSigningKeys is empty, a key is derived from SessionSecret.
+// The default SessionSecret is public, no key is derived from it.
+func (app *App) signingKeys() ([][]byte, error) {
+	keys := [][]byte{}
+	for _, k := range app.Config.URLSigningKeys {
+		keys = append(keys, []byte(k))
+	}
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	secret := app.Config.SessionSecret
+	if len(secret) == 0 || string(secret) == defaultSessionSecret {
+		return nil, ErrNoSigningKey
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("kwiscale signed url"))
+	return append(keys, mac.Sum(nil)), nil
+}
+
+// urlSignature returns the signature of path and query.
+func urlSignature(key []byte, path string, query url.Values) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path + "?" + query.Encode()))
+	return mac.Sum(nil)
+}
+
+// SignedURL returns the URL of route "name" (alias or handler name) with
+// pairs as route parameters, signed with the first Config.URLSigningKeys.
+// ErrNoSigningKey is returned if no key is configured. The URL expires after expiry, use 0 for a URL that never expires. Set
+// RouteOptions.Signed on the route to check signature before the handler
+// is called.
+func (app *App) SignedURL(name string, expiry time.Duration, pairs ...string) (*url.URL, error) {
+	var u *url.URL
+	for _, r := range app.GetRoutes(name) {
+		if ru, err := r.URL(pairs...); err == nil {
+			u = ru
+			break
+		}
+	}
+	if u == nil {
+		return nil, errors.New("no route " + name + " for the given parameters")
+	}
+
+	keys, err := app.signingKeys()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if expiry > 0 {
+		query.Set(expiresParam, strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	}
+	sig := urlSignature(keys[0], u.Path, query)
+	query.Set(signatureParam, base64.RawURLEncoding.EncodeToString(sig))
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+// VerifySignedURL checks the signature and expiry of the request URL. Every
+// Config.URLSigningKeys are tried, to let keys rotate.
+func (app *App) VerifySignedURL(r *http.Request) error {
+	keys, err := app.signingKeys()
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(signatureParam))
+	if err != nil || len(sig) == 0 {
+		return ErrInvalidSignature
+	}
+	query.Del(signatureParam)
+
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(sig, urlSignature(key, r.URL.Path, query)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	if e := query.Get(expiresParam); e != "" {
+		expires, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		if time.Now().Unix() > expires {
+			return ErrURLExpired
+		}
+	}
+	return nil
+}
+
+// signedURL is the built-in middleware that checks signed URLs on routes
+// with RouteOptions.Signed. It responds 403 if the URL is not valid.
+func (app *App) signedURL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentRoute(r).options.Signed {
+			if err := app.VerifySignedURL(r); err != nil {
+				if err == ErrNoSigningKey {
+					Error("Cannot verify signed URL", err)
+				}
+				app.Error(http.StatusForbidden, w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
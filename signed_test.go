@@ -0,0 +1,80 @@
+package kwiscale
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Test signature and key rotation of signed URLs.
+func TestSignedURL(t *testing.T) {
+	app := initApp(t)
+	app.Config.URLSigningKeys = []string{"old key"}
+	app.AddNamedRoute("/download/{id}", &TestHandler{}, "download")
+	app.RouteOptions("download").Signed = true
+
+	u, err := app.SignedURL("download", time.Hour, "id", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/download/42" || u.Query().Get("signature") == "" || u.Query().Get("expires") == "" {
+		t.Fatal("Bad signed URL", u)
+	}
+	if w := serve(app, u.String(), nil); w.Code != http.StatusOK {
+		t.Fatal("Signed URL should be accepted, got", w.Code)
+	}
+
+	// rotate keys, old URLs are still valid
+	app.Config.URLSigningKeys = []string{"new key", "old key"}
+	if w := serve(app, u.String(), nil); w.Code != http.StatusOK {
+		t.Fatal("URL signed with old key should be accepted, got", w.Code)
+	}
+
+	for name, path := range map[string]string{
+		"not signed": "/download/42",
+		"altered":    "/download/43?" + u.RawQuery,
+		"extended":   "/download/42?expires=9999999999&signature=" + u.Query().Get("signature"),
+	} {
+		if w := serve(app, path, nil); w.Code != http.StatusForbidden {
+			t.Errorf("%s URL should be refused, got %d", name, w.Code)
+		}
+	}
+}
+
+// Test that an expired URL with a valid signature is refused.
+func TestSignedURLExpired(t *testing.T) {
+	app := initApp(t)
+	app.Config.URLSigningKeys = []string{"key"}
+
+	q := url.Values{"expires": {"1"}}
+	sig := urlSignature([]byte("key"), "/download/42", q)
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(sig))
+	r, _ := http.NewRequest("GET", "http://example.com/download/42?"+q.Encode(), nil)
+	if err := app.VerifySignedURL(r); err != ErrURLExpired {
+		t.Fatal("URL should be expired, got", err)
+	}
+}
+
+// Test that URLs are not signed with the default session secret.
+func TestSignedURLDefaultSecret(t *testing.T) {
+	app := NewApp(&Config{})
+	app.AddNamedRoute("/file/{id}", &TestHandler{}, "file")
+	app.RouteOptions("file").Signed = true
+	if _, err := app.SignedURL("file", time.Hour, "id", "1"); err != ErrNoSigningKey {
+		t.Fatal("Default secret should not sign URLs, got", err)
+	}
+	if w := serve(app, "/file/1?signature=abc", nil); w.Code != http.StatusForbidden {
+		t.Fatal("Signed route should be refused without key, got", w.Code)
+	}
+
+	app.Config.SessionSecret = []byte("my secret")
+	u, err := app.SignedURL("file", time.Hour, "id", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(app, u.String(), nil); w.Code != http.StatusOK {
+		t.Fatal("URL signed with session secret should be accepted, got", w.Code)
+	}
+}
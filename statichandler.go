@@ -3,6 +3,7 @@ package kwiscale
 import (
 	"crypto/md5"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -19,6 +20,10 @@ func (s *staticHandler) Get() {
 	abs, _ := filepath.Abs(s.app.Config.StaticDir)
 	file = filepath.Join(abs, file)
 
+	if s.servePrecompressed(file) {
+		return
+	}
+
 	// control or add etag
 	if etag, err := eTag(file); err == nil {
 		s.response.Header().Add("ETag", etag)
@@ -31,6 +36,45 @@ func (s *staticHandler) Get() {
 		ServeHTTP(s.Response(), s.Request())
 }
 
+// precompressed file extensions by encoding.
+var precompressedExt = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// servePrecompressed serves "file.br" or "file.gz" instead of file if it
+// exists and client accepts the encoding. It returns false if no
+// precompressed file is served.
+func (s *staticHandler) servePrecompressed(file string) bool {
+	encoding := negotiateEncoding(s.request.Header.Get("Accept-Encoding"), []string{"br", "gzip"})
+	if encoding == "" || checkPath(s.Vars["file"]) != nil {
+		return false
+	}
+	f, err := os.Open(file + precompressedExt[encoding])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return false
+	}
+
+	h := s.response.Header()
+	if ctype := mime.TypeByExtension(filepath.Ext(file)); ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+	if etag, err := eTag(f.Name()); err == nil {
+		h.Set("ETag", etag)
+	}
+	h.Set("Content-Encoding", encoding)
+	if h.Get("Vary") == "" {
+		h.Set("Vary", "Accept-Encoding")
+	}
+	http.ServeContent(s.response, s.request, filepath.Base(file), stat.ModTime(), f)
+	return true
+}
+
 // Get a etag for the file. It's constuct with a md5 sum of
 // <filename> + "." + <modification-time>
 func eTag(file string) (string, error) {
@@ -97,6 +97,16 @@ func (tpl *BuiltInTemplate) Render(w io.Writer, file string, ctx interface{}) er
 		}
 		return url.String()
 	}
+	tpl.funcMap["csrf_token"] = func() string {
+		return csrfToken(w.(WebHandler).Request())
+	}
+	tpl.funcMap["csrf_field"] = func() template.HTML {
+		h := w.(WebHandler)
+		return csrfField(h.App(), h.Request())
+	}
+	tpl.funcMap["csp_nonce"] = func() string {
+		return cspNonce(w.(WebHandler).Request())
+	}
 	tpl.funcMap["url"] = func(handler string, args ...interface{}) string {
 		pairs := []string{}
 		for _, p := range args {
@@ -0,0 +1,209 @@
+package kwiscale
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is sent when a handler doesn't respond in time.
+var ErrTimeout = errors.New("Handler timeout")
+
+// handlerPanic holds a panic raised in a handler goroutine, with the stack
+// of that goroutine.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// timeoutWriter is given to handlers that have a timeout. Headers are kept
+// apart until the first write, and writes are refused after the timeout.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	// base is a copy of the writer headers when the handler started
+	base     http.Header
+	lock     sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// Header returns the handler headers.
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// writeHeader sends headers, lock must be held.
+func (tw *timeoutWriter) writeHeader(status int) {
+	if tw.started {
+		return
+	}
+	tw.started = true
+	tw.copyHeader()
+	tw.w.WriteHeader(status)
+}
+
+// copyHeader merges the handler headers in the writer headers, lock must be
+// held. Values added to the writer since the handler started are kept after
+// the handler ones, keys removed by the handler are removed.
+func (tw *timeoutWriter) copyHeader() {
+	dst := tw.w.Header()
+	for k, v := range tw.base {
+		if _, ok := tw.header[k]; !ok && len(dst[k]) <= len(v) {
+			delete(dst, k)
+		}
+	}
+	for k, v := range tw.header {
+		var added []string
+		if n := len(tw.base[k]); len(dst[k]) > n {
+			added = dst[k][n:]
+		}
+		dst[k] = append(v[:len(v):len(v)], added...)
+	}
+}
+
+// WriteHeader sends status, unless the handler timed out.
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(status)
+}
+
+// Write sends data, http.ErrHandlerTimeout is returned if the handler
+// timed out.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (tw *timeoutWriter) Flush() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		tw.writeHeader(http.StatusOK)
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// timeoutFor returns the timeout of the request route, the global timeout
+// doesn't apply to built-in routes.
+func (app *App) timeoutFor(r *http.Request) time.Duration {
+	options := currentRoute(r).options
+	if options.Timeout != 0 || options.builtin {
+		return options.Timeout
+	}
+	return app.Config.Timeout
+}
+
+// timeout is the built-in middleware that cancels the request context when
+// the route timeout is reached. If nothing was written, an error 503 is sent.
+// Websocket requests are not concerned.
+func (app *App) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := app.timeoutFor(r)
+		if d <= 0 || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{
+			w:      w,
+			header: w.Header().Clone(),
+			base:   w.Header().Clone(),
+		}
+		var hw http.ResponseWriter = tw
+		session := requestSession(r)
+		if session != nil {
+			// session cookies must be set in the handler headers, the
+			// writer headers belong to this goroutine
+			session.bind(tw)
+			hw = &sessionWriter{ResponseWriter: tw, save: session.saveOrLog}
+		}
+		done := make(chan struct{})
+		panics := make(chan *handlerPanic, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panics <- &handlerPanic{p, stack()}
+				}
+			}()
+			next.ServeHTTP(hw, r)
+			if session != nil {
+				session.saveOrLog()
+			}
+			close(done)
+		}()
+
+		// finish sends the headers of a handler that wrote nothing
+		finish := func() {
+			tw.lock.Lock()
+			if !tw.started {
+				tw.copyHeader()
+			}
+			tw.lock.Unlock()
+			if session != nil {
+				session.bind(w)
+			}
+		}
+
+		select {
+		case <-done:
+			finish()
+		case p := <-panics:
+			panic(p)
+		case <-ctx.Done():
+			select {
+			case <-done:
+				finish()
+				return
+			default:
+			}
+
+			tw.lock.Lock()
+			if tw.started {
+				// too late to send an error, wait for the handler
+				tw.lock.Unlock()
+				select {
+				case <-done:
+					finish()
+				case p := <-panics:
+					panic(p)
+				}
+				return
+			}
+			tw.timedOut = true
+			tw.lock.Unlock()
+			if session != nil {
+				session.stop()
+			}
+
+			app.timeouts.Add(1)
+			Error("Handler timeout", currentRoute(r).name, r.Method, r.URL, d)
+			app.Error(http.StatusServiceUnavailable, w, ErrTimeout, d)
+		}
+	})
+}
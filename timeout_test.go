@@ -0,0 +1,98 @@
+package kwiscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A handler that waits for request cancellation.
+type slowHandler struct{ RequestHandler }
+
+func (h *slowHandler) Get() {
+	select {
+	case <-h.Request().Context().Done():
+		// let the timeout be handled first
+		time.Sleep(20 * time.Millisecond)
+	case <-time.After(time.Second):
+	}
+	h.WriteString("too late")
+}
+
+// Test that a slow handler is cancelled and responds 503.
+func TestTimeout(t *testing.T) {
+	app := initApp(t)
+	app.Config.Timeout = time.Second
+	app.AddNamedRoute("/slow", &slowHandler{}, "slow")
+	app.AddRoute("/foo", &TestHandler{})
+	app.RouteOptions("slow").Timeout = 20 * time.Millisecond
+
+	r, _ := http.NewRequest("GET", "http://example.com/slow", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	app.ServeHTTP(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatal("Slow handler should respond 503, got", w.Code)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("Route timeout is not used")
+	}
+	if app.timeouts.Load() != 1 {
+		t.Fatal("Timeout is not counted")
+	}
+
+	r, _ = http.NewRequest("GET", "http://example.com/foo", nil)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "Hello" {
+		t.Fatal("Fast handler should respond, got", w.Code, w.Body.String())
+	}
+}
+
+// lateLoginDone receives the error of a session change made by
+// lateLoginHandler.
+var lateLoginDone = make(chan error, 1)
+
+// A handler that keeps logging in while its timeout is handled, until the
+// session refuses changes.
+type lateLoginHandler struct{ RequestHandler }
+
+func (h *lateLoginHandler) Get() {
+	<-h.Request().Context().Done()
+	var err error
+	for end := time.Now().Add(time.Second); err == nil && time.Now().Before(end); {
+		h.Login(&User{ID: "late"})
+		h.Response().Header().Set("X-Late", "yes")
+		err = h.Session().Set("late", "yes")
+	}
+	lateLoginDone <- err
+}
+
+// Test that sessions are safe to use in a timed out handler, and that the
+// session cookie of a handler with a timeout is sent.
+func TestTimeoutSession(t *testing.T) {
+	app := sessionApp(t, "memory", nil)
+	app.Config.Timeout = time.Second
+	app.AddNamedRoute("/late", &lateLoginHandler{}, "late")
+	app.RouteOptions("late").Timeout = 20 * time.Millisecond
+
+	w := serve(app, "/login/bob", nil)
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) == 0 {
+		t.Fatal("Login with a timeout should set the session cookie, got", w.Code, w.Header())
+	}
+
+	for i := 0; i < 10; i++ {
+		w = serve(app, "/late", nil)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatal("Slow handler should respond 503, got", w.Code)
+		}
+		if w.Header().Get("X-Late") != "" {
+			t.Fatal("Headers of a timed out handler should not be sent")
+		}
+		if err := <-lateLoginDone; err != ErrTimeout {
+			t.Fatal("Session should refuse changes after the timeout, got", err)
+		}
+	}
+}
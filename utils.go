@@ -1,6 +1,8 @@
 package kwiscale
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"log"
 	"net/http"
 	"strings"
@@ -10,7 +12,7 @@ import (
 
 // Log print logs on STDOUT if debug is activated.
 func Log(v ...interface{}) {
-	if debug {
+	if debug.Load() {
 		log.Println(v...)
 	}
 }
@@ -22,6 +24,15 @@ func Error(v ...interface{}) {
 	log.Println(msg...)
 }
 
+// randomToken returns a random url safe string.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 // getMatchRoute returns the better handler that matched request url.
 // It returns handlername, mux.Route and mux.RouteMatch.
 //
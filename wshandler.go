@@ -1,38 +1,166 @@
 package kwiscale
 
-import "github.com/gorilla/websocket"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
-var (
-	// keep connection by path.
-	rooms = make(map[string]*wsroom, 0)
+// websocket write settings.
+const (
+	// wsQueueSize is the number of messages waiting to be written for a
+	// connection, a client that doesn't read fast enough is disconnected
+	// when a broadcast finds its queue full
+	wsQueueSize = 256
+	// wsWriteWait is the time allowed to write a message
+	wsWriteWait = 10 * time.Second
 )
 
+// ErrWSClosed is returned when a message is sent on a closed websocket
+// connection.
+var ErrWSClosed = errors.New("websocket connection is closed")
+
+// keep connections by room name.
+var rooms = &roomRegistry{
+	rooms:  make(map[string]*wsroom),
+	joined: make(map[*WebSocketHandler]map[string]bool),
+}
+
+// roomRegistry keeps the rooms, it is shared by every connections.
+type roomRegistry struct {
+	lock  sync.RWMutex
+	rooms map[string]*wsroom
+	// joined keeps the rooms of each connection
+	joined map[*WebSocketHandler]map[string]bool
+}
+
 type wsroom struct {
 	// connections for the room
 	conns map[*WebSocketHandler]bool
 }
 
-// Returns the room named "path", or create one if not exists.
-func getRoom(path string) *wsroom {
-	if r, ok := rooms[path]; !ok {
-		r = new(wsroom)
-		r.conns = make(map[*WebSocketHandler]bool)
-		rooms[path] = r
+// add appends a websocket handler to the room named "name", the room is
+// created if it doesn't exist. Closed connections are not added.
+func (r *roomRegistry) add(name string, c *WebSocketHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if c.left {
+		return
 	}
+	room, ok := r.rooms[name]
+	if !ok {
+		room = &wsroom{conns: make(map[*WebSocketHandler]bool)}
+		r.rooms[name] = room
+	}
+	room.conns[c] = true
+	if r.joined[c] == nil {
+		r.joined[c] = make(map[string]bool)
+	}
+	r.joined[c][name] = true
+}
 
-	return rooms[path]
+// remove removes a websocket handler from the room.
+func (r *roomRegistry) remove(name string, c *WebSocketHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removeLocked(name, c)
 }
 
-// Add a websocket handler to the room.
-func (room *wsroom) add(c *WebSocketHandler) {
-	room.conns[c] = true
+// removeLocked removes a websocket handler from the room, empty rooms are
+// removed. Lock must be held.
+func (r *roomRegistry) removeLocked(name string, c *WebSocketHandler) {
+	if room, ok := r.rooms[name]; ok {
+		if _, ok := room.conns[c]; ok {
+			Log("Remove websocket connection", c)
+			delete(room.conns, c)
+		}
+		if len(room.conns) == 0 {
+			delete(r.rooms, name)
+		}
+	}
+	delete(r.joined[c], name)
+	if len(r.joined[c]) == 0 {
+		delete(r.joined, c)
+	}
+}
+
+// close removes a websocket handler from every rooms, it cannot join
+// rooms anymore.
+func (r *roomRegistry) close(c *WebSocketHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c.left = true
+	for name := range r.joined[c] {
+		r.removeLocked(name, c)
+	}
+}
+
+// roomsOf returns the rooms of a websocket handler, sorted by name.
+func (r *roomRegistry) roomsOf(c *WebSocketHandler) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := []string{}
+	for name := range r.joined[c] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// members returns the connections of a room, the room may not exist.
+func (r *roomRegistry) members(name string) []*WebSocketHandler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	members := []*WebSocketHandler{}
+	if room, ok := r.rooms[name]; ok {
+		for c := range room.conns {
+			members = append(members, c)
+		}
+	}
+	return members
+}
+
+// all returns every connections, once.
+func (r *roomRegistry) all() []*WebSocketHandler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	seen := map[*WebSocketHandler]bool{}
+	all := []*WebSocketHandler{}
+	for _, room := range r.rooms {
+		for c := range room.conns {
+			if !seen[c] {
+				seen[c] = true
+				all = append(all, c)
+			}
+		}
+	}
+	return all
 }
 
-// Remove a websocket handler from the room.
-func (room *wsroom) remove(c *WebSocketHandler) {
-	if _, ok := room.conns[c]; ok {
-		Log("Remove websocket connection", c)
-		delete(room.conns, c)
+// stats returns the number of connections for each room.
+func (r *roomRegistry) stats() map[string]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	stats := map[string]int{}
+	for name, room := range r.rooms {
+		stats[name] = len(room.conns)
+	}
+	return stats
+}
+
+// broadcast queues a message for every connections without blocking,
+// connections with a full queue are evicted.
+func broadcast(conns []*WebSocketHandler, b []byte) {
+	for _, c := range conns {
+		if !c.enqueue(b) {
+			go c.evict()
+		}
 	}
 }
 
@@ -69,27 +197,128 @@ type WSHandler interface {
 //	}
 //
 // Previous example send back the message + a greeting message
+//
+// Session is readable during the connection lifetime, it is a snapshot taken
+// at upgrade. Changes are only possible in Init() and OnConnect(), they are
+// sent with the upgrade response.
+//
+// Messages are written by a goroutine for each connection, so every Send
+// methods may be called concurrently. Don't write on GetConnection()
+// directly.
 type WebSocketHandler struct {
 	BaseHandler
 	conn *websocket.Conn
+
+	// messages sent and rooms joined before upgrade, eg. in OnConnect()
+	pending   [][]byte
+	joinRooms []string
+	// left is set when the connection is removed from rooms, it is
+	// protected by the rooms lock
+	left bool
+
+	// write queue, done is closed by Close(), stopped when the writer
+	// returns
+	out       chan []byte
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
-// upgrade protocol to use websocket communication
+// upgrade protocol to use websocket communication. Session changes are
+// saved and the cookies are given to the upgrade response, then the
+// session becomes read only.
 func (ws *WebSocketHandler) upgrade() error {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
+	ws.saveSession()
+	ws.Session().freeze()
+	header := http.Header{}
+	if cookies := ws.response.Header()["Set-Cookie"]; len(cookies) > 0 {
+		header["Set-Cookie"] = cookies
+	}
+
 	var err error
-	ws.conn, err = upgrader.Upgrade(ws.response, ws.request, nil)
-	if err == nil {
+	ws.conn, err = upgrader.Upgrade(ws.response, ws.request, header)
+	if err != nil {
+		return err
+	}
+
+	// start writer with messages given before upgrade
+	ws.out = make(chan []byte, wsQueueSize+len(ws.pending))
+	ws.done = make(chan struct{})
+	ws.stopped = make(chan struct{})
+	for _, b := range ws.pending {
+		ws.out <- b
+	}
+	ws.pending = nil
+	go ws.writeLoop()
+
+	// record room and append connection
+	rooms.add(ws.request.URL.Path, ws)
+	for _, name := range ws.joinRooms {
+		rooms.add(name, ws)
+	}
+	ws.joinRooms = nil
+	return nil
+}
+
+// writeLoop writes queued messages until Close() is called, remaining
+// messages are then written. The connection is closed on error.
+func (ws *WebSocketHandler) writeLoop() {
+	defer close(ws.stopped)
+	for {
+		select {
+		case b := <-ws.out:
+			if err := ws.writeMessage(b); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-ws.done:
+			// one deadline for remaining messages
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			for {
+				select {
+				case b := <-ws.out:
+					if err := ws.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeMessage writes a text message with a deadline.
+func (ws *WebSocketHandler) writeMessage(b []byte) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return ws.conn.WriteMessage(websocket.TextMessage, b)
+}
 
-		// record room and append connection
-		path := ws.request.URL.Path
-		room := getRoom(path)
-		room.add(ws)
+// enqueue gives a message to the writer without blocking, false is
+// returned if the queue is full.
+func (ws *WebSocketHandler) enqueue(b []byte) bool {
+	select {
+	case ws.out <- b:
+		return true
+	case <-ws.done:
+		return true
+	case <-ws.stopped:
+		return true
+	default:
+		return false
 	}
-	return err
+}
+
+// evict disconnects a client that doesn't read its messages.
+func (ws *WebSocketHandler) evict() {
+	Log("Evict slow websocket client", ws.request.RemoteAddr)
+	rooms.close(ws)
+	closeWS(ws, websocket.CloseTryAgainLater, "slow consumer")
+	ws.conn.Close()
 }
 
 // GetConnection returns the websocket client connection.
@@ -97,7 +326,9 @@ func (ws *WebSocketHandler) GetConnection() *websocket.Conn {
 	return ws.conn
 }
 
-// OnConnect is called when a client connection is opened.
+// OnConnect is called when a client connection is opened, before the
+// upgrade. If an error is returned, the connection is refused with an
+// error 403. Messages sent here are given after the upgrade.
 func (ws *WebSocketHandler) OnConnect() error {
 	return nil
 }
@@ -107,8 +338,21 @@ func (ws *WebSocketHandler) OnClose() error {
 	return nil
 }
 
+// Write queues a text message to the current client, it waits if the queue
+// is full.
 func (ws *WebSocketHandler) Write(b []byte) error {
-	return ws.conn.WriteMessage(websocket.TextMessage, b)
+	if ws.out == nil {
+		ws.pending = append(ws.pending, b)
+		return nil
+	}
+	select {
+	case ws.out <- b:
+		return nil
+	case <-ws.done:
+		return ErrWSClosed
+	case <-ws.stopped:
+		return ErrWSClosed
+	}
 }
 
 // WriteString is an alias to SendText.
@@ -123,12 +367,16 @@ func (ws *WebSocketHandler) WriteJSON(i interface{}) error {
 
 // SendJSON send interface "i" in json form to the current client.
 func (ws *WebSocketHandler) SendJSON(i interface{}) error {
-	return ws.conn.WriteJSON(i)
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return ws.Write(b)
 }
 
 // SendText send string "s" to the current client.
 func (ws *WebSocketHandler) SendText(s string) error {
-	return ws.conn.WriteMessage(websocket.TextMessage, []byte(s))
+	return ws.Write([]byte(s))
 }
 
 // SendJSONToThisRoom send interface "i" in json form to the client connected
@@ -138,19 +386,26 @@ func (ws *WebSocketHandler) SendJSONToThisRoom(i interface{}) {
 }
 
 // SendJSONToRoom send the interface "i" in json form to the client connected
-// to the the room named "name".
+// to the the room named "name". Clients that don't read their messages are
+// disconnected.
 func (ws *WebSocketHandler) SendJSONToRoom(room string, i interface{}) {
-	for w := range rooms[room].conns {
-		w.SendJSON(i)
+	b, err := json.Marshal(i)
+	if err != nil {
+		Error("Cannot send JSON to room", room, err)
+		return
 	}
+	broadcast(rooms.members(room), b)
 }
 
 // SendJSONToAll send the interface "i" in json form to the entire
 // client list.
 func (ws *WebSocketHandler) SendJSONToAll(i interface{}) {
-	for name := range rooms {
-		ws.SendJSONToRoom(name, i)
+	b, err := json.Marshal(i)
+	if err != nil {
+		Error("Cannot send JSON to all", err)
+		return
 	}
+	broadcast(rooms.all(), b)
 }
 
 // SendTextToThisRoom send message s to the room of the
@@ -161,27 +416,70 @@ func (ws *WebSocketHandler) SendTextToThisRoom(s string) {
 
 // SendTextToRoom send message "s" to the room named "name".
 func (ws *WebSocketHandler) SendTextToRoom(name, s string) {
-	for w := range rooms[name].conns {
-		w.SendText(s)
-	}
+	broadcast(rooms.members(name), []byte(s))
 }
 
 // SendTextToAll send message "s" to the entire list of connected clients.
 func (ws *WebSocketHandler) SendTextToAll(s string) {
-	for name := range rooms {
-		ws.SendTextToRoom(name, s)
+	broadcast(rooms.all(), []byte(s))
+}
+
+// Join appends the connection to the room named "name". Clients are also
+// in the room named by the request path. Rooms joined before the upgrade,
+// eg. in OnConnect(), are joined when the upgrade is done.
+func (ws *WebSocketHandler) Join(name string) {
+	if ws.out == nil {
+		for _, n := range ws.joinRooms {
+			if n == name {
+				return
+			}
+		}
+		ws.joinRooms = append(ws.joinRooms, name)
+		return
+	}
+	rooms.add(name, ws)
+}
+
+// Leave removes the connection from the room named "name".
+func (ws *WebSocketHandler) Leave(name string) {
+	if ws.out == nil {
+		for i, n := range ws.joinRooms {
+			if n == name {
+				ws.joinRooms = append(ws.joinRooms[:i], ws.joinRooms[i+1:]...)
+				return
+			}
+		}
+		return
+	}
+	rooms.remove(name, ws)
+}
+
+// Rooms returns the rooms of the connection, sorted by name.
+func (ws *WebSocketHandler) Rooms() []string {
+	if ws.out == nil {
+		names := append([]string{}, ws.joinRooms...)
+		sort.Strings(names)
+		return names
 	}
+	return rooms.roomsOf(ws)
+}
+
+// RoomMembers returns the connections of the room named "name", the list
+// is empty if the room doesn't exist.
+func (ws *WebSocketHandler) RoomMembers(name string) []*WebSocketHandler {
+	return rooms.members(name)
 }
 
-// Close connection after having removed handler from the rooms stack.
+// Close connection after having removed handler from every rooms. Queued
+// messages are written before.
 func (ws *WebSocketHandler) Close() {
 	defer ws.conn.Close()
-	if room, ok := rooms[ws.request.URL.Path]; ok {
-		room.remove(ws)
-		if len(room.conns) == 0 {
-			delete(rooms, ws.request.URL.Path)
-		}
+	rooms.close(ws)
+	if ws.done == nil {
+		return
 	}
+	ws.closeOnce.Do(func() { close(ws.done) })
+	<-ws.stopped
 }
 
 // WSServerHandler interface to serve continuously.
@@ -201,18 +499,74 @@ type WSStringHandler interface {
 	OnMessage(int, string, error)
 }
 
-func serveWS(w WSHandler) {
+// serveWebSocket serves the upgraded connection with the loop that matches
+// the handler type. A panic is recovered for this connection only, then the
+// connection is closed and removed from its room before OnClose is called.
+func serveWebSocket(w WSHandler) {
+	defer w.OnClose()
 	defer w.Close()
+	defer recoverWS(w)
+
+	switch w.(type) {
+	case WSServerHandler:
+		serveWS(w)
+	case WSJsonHandler:
+		serveJSON(w)
+	case WSStringHandler:
+		serveString(w)
+	default:
+		Error("Websocket handler doesn't implement Serve, OnJSON or OnMessage", w)
+		closeWS(w, websocket.CloseUnsupportedData, ErrNotImplemented.Error())
+	}
+}
+
+// recoverWS recovers a panic from websocket handler, reports the error and
+// sends a close frame with "internal server error" code.
+func recoverWS(w WSHandler) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	trace := stack()
+	Error("Websocket handler panics", p, "\n", string(trace))
+
+	if h, ok := w.(WebHandler); ok {
+		h.App().report(&ErrorReport{
+			Status: http.StatusInternalServerError,
+			Error:  fmt.Errorf("websocket handler panics: %v", p),
+			Panic:  p,
+			Stack:  trace,
+		}, h.getResponse())
+	}
+
+	closeWS(w, websocket.CloseInternalServerErr, "unexpected error")
+}
+
+// closeWS sends a close frame with code and reason to client.
+func closeWS(w WSHandler, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	deadline := time.Now().Add(time.Second)
+	if err := w.GetConnection().WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+		Log("Cannot send websocket close frame", err)
+	}
+}
+
+func serveWS(w WSHandler) {
 	w.(WSServerHandler).Serve()
 }
 
 // Serve JSON.
 func serveJSON(w WSHandler) {
 	c := w.GetConnection()
-	defer w.Close()
+	allow := wsLimiter(w)
 	for {
 		var i interface{}
 		err := c.ReadJSON(&i)
+		if err == nil && !allow() {
+			closeWS(w, websocket.ClosePolicyViolation, ErrTooManyRequests.Error())
+			return
+		}
 		w.(WSJsonHandler).OnJSON(i, err)
 		if err != nil {
 			return
@@ -223,9 +577,13 @@ func serveJSON(w WSHandler) {
 // Serve string messages
 func serveString(w WSHandler) {
 	c := w.GetConnection()
-	defer w.Close()
+	allow := wsLimiter(w)
 	for {
 		i, p, err := c.ReadMessage()
+		if err == nil && !allow() {
+			closeWS(w, websocket.ClosePolicyViolation, ErrTooManyRequests.Error())
+			return
+		}
 		w.(WSStringHandler).OnMessage(i, string(p), err)
 		if err != nil {
 			return
@@ -0,0 +1,284 @@
+package kwiscale
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A websocket handler that panics on message.
+type wsPanicHandler struct {
+	WebSocketHandler
+}
+
+func (h *wsPanicHandler) OnJSON(i interface{}, err error) {
+	if err == nil {
+		panic("ws boom")
+	}
+}
+
+// Dial the websocket "path" on server.
+func dialWS(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal("Cannot dial websocket:", err)
+	}
+	return c
+}
+
+// Test that a panic closes the connection with an error code and is reported.
+func TestWebSocketPanic(t *testing.T) {
+	app := initApp(t)
+	reporter := &testReporter{}
+	app.AddErrorReporter(reporter)
+	app.AddRoute("/ws-panic", &wsPanicHandler{})
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	c := dialWS(t, server, "/ws-panic")
+	defer c.Close()
+	c.WriteJSON(map[string]string{"hello": "world"})
+
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatal("Connection should be closed with internal error code, got", err)
+	}
+
+	// reporting is done before connection is closed on server side
+	if len(reporter.reports) != 1 || reporter.reports[0].Panic != "ws boom" {
+		t.Fatal("Websocket panic is not reported:", reporter.reports)
+	}
+}
+
+// A websocket handler that changes session before upgrade.
+type wsSessionHandler struct {
+	WebSocketHandler
+}
+
+func (h *wsSessionHandler) Init() (int, error) {
+	h.SetSession("a", "init")
+	return -1, nil
+}
+
+func (h *wsSessionHandler) OnConnect() error {
+	h.SetSession("b", "connect")
+	h.SendText("welcome")
+	return nil
+}
+
+func (h *wsSessionHandler) OnMessage(_ int, msg string, err error) {
+	if err != nil {
+		return
+	}
+	a, _ := h.GetSession("a")
+	b, _ := h.GetSession("b")
+	h.SendText(fmt.Sprint(a, " ", b, " ", h.Session().Set("c", msg)))
+}
+
+// Test that session changes are sent with upgrade response, and refused
+// afterward.
+func TestWebSocketSession(t *testing.T) {
+	app := sessionApp(t, "default", nil)
+	app.AddRoute("/ws-session", &wsSessionHandler{})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws-session"
+	c, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal("Cannot dial websocket:", err)
+	}
+	defer c.Close()
+
+	if _, msg, _ := c.ReadMessage(); string(msg) != "welcome" {
+		t.Fatal("Message sent in OnConnect should be received, got", string(msg))
+	}
+	c.WriteMessage(websocket.TextMessage, []byte("x"))
+	if _, msg, _ := c.ReadMessage(); string(msg) != "init connect "+ErrSessionReadOnly.Error() {
+		t.Fatal("Session should be read only after upgrade, got", string(msg))
+	}
+
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Session cookie should be sent with upgrade response")
+	}
+	cookie := http.Header{"Cookie": {cookies[len(cookies)-1].Name + "=" + cookies[len(cookies)-1].Value}}
+	for key, value := range map[string]string{"a": "init", "b": "connect", "c": "-"} {
+		if w := serve(app, "/get/"+key, cookie); w.Body.String() != value {
+			t.Fatalf("Session %s should be %s, got %s", key, value, w.Body.String())
+		}
+	}
+}
+
+// A websocket handler that sends received messages to its room.
+type wsRoomHandler struct {
+	WebSocketHandler
+}
+
+func (h *wsRoomHandler) OnMessage(_ int, msg string, err error) {
+	if err == nil {
+		h.SendTextToThisRoom(msg)
+	}
+}
+
+// waitMembers waits until room has n members.
+func waitMembers(t *testing.T, room string, n int) {
+	for i := 0; i < 200; i++ {
+		if len(rooms.members(room)) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Room %s should have %d members, got %d", room, n, len(rooms.members(room)))
+}
+
+// Test concurrent broadcasts in a room.
+func TestWebSocketBroadcast(t *testing.T) {
+	app := initApp(t)
+	app.AddRoute("/ws-room", &wsRoomHandler{})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	const clients = 5
+	conns := []*websocket.Conn{}
+	for i := 0; i < clients; i++ {
+		c := dialWS(t, server, "/ws-room")
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	waitMembers(t, "/ws-room", clients)
+
+	wg := sync.WaitGroup{}
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c *websocket.Conn) {
+			defer wg.Done()
+			c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprint(i)))
+			for n := 0; n < clients; n++ {
+				if _, _, err := c.ReadMessage(); err != nil {
+					t.Error("Client", i, "should receive every messages:", err)
+					return
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	waitMembers(t, "/ws-room", 0)
+
+	// missing room
+	(&WebSocketHandler{}).SendJSONToRoom("/not-a-room", "hello")
+}
+
+// Test that a client that doesn't read is evicted without blocking
+// broadcast.
+func TestWebSocketSlowConsumer(t *testing.T) {
+	app := initApp(t)
+	app.AddRoute("/ws-slow", &wsRoomHandler{})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	c := dialWS(t, server, "/ws-slow")
+	defer c.Close()
+	waitMembers(t, "/ws-slow", 1)
+
+	msg := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	h := &WebSocketHandler{}
+	for i := 0; i < 2000 && len(rooms.members("/ws-slow")) > 0; i++ {
+		h.SendTextToRoom("/ws-slow", msg)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Broadcast should not wait for slow clients")
+	}
+	waitMembers(t, "/ws-slow", 0)
+}
+
+// A websocket handler that joins and leaves named rooms:
+// "join room", "leave room", "rooms" and "say room message".
+type wsChatHandler struct {
+	WebSocketHandler
+}
+
+func (h *wsChatHandler) OnConnect() error {
+	h.Join("everyone")
+	return nil
+}
+
+func (h *wsChatHandler) OnMessage(_ int, msg string, err error) {
+	if err != nil {
+		return
+	}
+	args := strings.SplitN(msg, " ", 3)
+	switch args[0] {
+	case "join":
+		h.Join(args[1])
+		h.SendText("joined")
+	case "leave":
+		h.Leave(args[1])
+		h.SendText("left")
+	case "rooms":
+		h.SendText(strings.Join(h.Rooms(), ","))
+	case "say":
+		h.SendTextToRoom(args[1], args[2])
+	}
+}
+
+// Test joining and leaving named rooms.
+func TestWebSocketRooms(t *testing.T) {
+	app := initApp(t)
+	app.AddRoute("/ws-chat", &wsChatHandler{})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	// send writes a message and returns the reply
+	send := func(c *websocket.Conn, msg string) string {
+		c.WriteMessage(websocket.TextMessage, []byte(msg))
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, reply, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal("No reply to", msg, err)
+		}
+		return string(reply)
+	}
+
+	a := dialWS(t, server, "/ws-chat")
+	defer a.Close()
+	b := dialWS(t, server, "/ws-chat")
+	defer b.Close()
+	waitMembers(t, "everyone", 2)
+
+	send(a, "join lobby")
+	send(b, "join lobby")
+	if rooms := send(a, "rooms"); rooms != "/ws-chat,everyone,lobby" {
+		t.Fatal("Rooms are wrong, got", rooms)
+	}
+	if msg := send(a, "say lobby hello"); msg != "hello" {
+		t.Fatal("Sender should receive its message, got", msg)
+	}
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, msg, _ := b.ReadMessage(); string(msg) != "hello" {
+		t.Fatal("Room member should receive the message, got", string(msg))
+	}
+
+	send(b, "leave lobby")
+	waitMembers(t, "lobby", 1)
+
+	a.Close()
+	waitMembers(t, "lobby", 0)
+	waitMembers(t, "everyone", 1)
+	if rooms := send(b, "rooms"); rooms != "/ws-chat,everyone" {
+		t.Fatal("Left rooms should be removed, got", rooms)
+	}
+}